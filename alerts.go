@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+var (
+	alertsFile     = flag.String("alerts", "data/alerts.json", "alert rules file, updated by the /alerts API")
+	alertWebhook   = flag.String("alertWebhook", "", "default URL that alert matches are POSTed to, for rules without their own webhook")
+	alertRetries   = flag.Int("alertRetries", 5, "how many times a failed webhook delivery is retried")
+	alertRetryWait = flag.Duration("alertRetryWait", 2*time.Second, "wait before retrying a failed webhook delivery, doubled after each attempt")
+)
+
+// maxSentAlerts bounds the memory of notified matches. When it's reached,
+// the memory is cleared, at the cost of some repeated notifications.
+const maxSentAlerts = 100000
+
+// alertQueueSize limits the matches waiting for delivery. Matches beyond it
+// are dropped rather than holding up the market data.
+const alertQueueSize = 256
+
+// AlertRule describes the market events someone wants to be notified about.
+//
+// A "route" rule matches any route from Station, or from any station in
+// System, whose profit per unit is at least MinProfit.
+//
+// A "price" rule matches a station buying Item for more than SellAbove, or
+// selling it for less than BuyBelow. With Near and Radius, only stations
+// within Radius LY of the Near system match.
+type AlertRule struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Webhook is the URL matches are POSTed to. It defaults to the
+	// -alertWebhook flag.
+	Webhook string `json:"webhook,omitempty"`
+
+	Station   string  `json:"station,omitempty"`
+	System    string  `json:"system,omitempty"`
+	MinProfit float64 `json:"minProfit,omitempty"`
+	// JumpRange limits route rules to reachable destinations. Zero means
+	// no limit.
+	JumpRange float64 `json:"jumpRange,omitempty"`
+
+	Item      string  `json:"item,omitempty"`
+	SellAbove float64 `json:"sellAbove,omitempty"`
+	BuyBelow  float64 `json:"buyBelow,omitempty"`
+	Near      string  `json:"near,omitempty"`
+	Radius    float64 `json:"radius,omitempty"`
+
+	// Notified is the time of the newest quote delivered for this rule,
+	// but no later than its delivery. Older quotes, e.g. replayed from the
+	// cache after a restart, aren't checked again.
+	Notified *time.Time `json:"notified,omitempty"`
+}
+
+func (rule AlertRule) validate() error {
+	switch rule.Kind {
+	case "route":
+		if rule.Station == "" && rule.System == "" {
+			return fmt.Errorf("route alert without a station or system")
+		}
+		if rule.MinProfit <= 0 {
+			return fmt.Errorf("route alert without a positive minProfit")
+		}
+		if rule.JumpRange < 0 {
+			return fmt.Errorf("route alert with a negative jumpRange")
+		}
+	case "price":
+		if rule.Item == "" {
+			return fmt.Errorf("price alert without an item")
+		}
+		if rule.SellAbove <= 0 && rule.BuyBelow <= 0 {
+			return fmt.Errorf("price alert without sellAbove or buyBelow")
+		}
+		if rule.SellAbove < 0 || rule.BuyBelow < 0 || rule.Radius < 0 {
+			return fmt.Errorf("price alert with a negative threshold")
+		}
+		if rule.Radius > 0 && rule.Near == "" {
+			return fmt.Errorf("price alert with a radius but no near system")
+		}
+	default:
+		return fmt.Errorf("unknown alert kind %q, wanted route or price", rule.Kind)
+	}
+	webhook := rule.webhook()
+	if webhook == "" {
+		return fmt.Errorf("alert without a webhook and no -alertWebhook default")
+	}
+	if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("alert webhook %q isn't an http or https URL", webhook)
+	}
+	return nil
+}
+
+// fresh reports whether a quote is newer than the ones already notified.
+func (rule AlertRule) fresh(t emdn.Transaction) bool {
+	return rule.Notified == nil || t.Timestamp.After(*rule.Notified)
+}
+
+func (rule AlertRule) webhook() string {
+	if rule.Webhook != "" {
+		return rule.Webhook
+	}
+	return *alertWebhook
+}
+
+// origin reports whether a route rule watches routes from station.
+func (rule AlertRule) origin(station string) bool {
+	return station == rule.Station || (rule.System != "" && star(station) == rule.System)
+}
+
+// AlertMatch is a market event matching a rule, as POSTed to webhooks.
+type AlertMatch struct {
+	Item string `json:"item"`
+	// Station sells the item for route alerts and buy alerts, and buys it
+	// for sell alerts.
+	Station     string  `json:"station"`
+	Destination string  `json:"destination,omitempty"`
+	BuyPrice    float64 `json:"buyPrice,omitempty"`
+	SellPrice   float64 `json:"sellPrice,omitempty"`
+	Profit      float64 `json:"profit,omitempty"`
+	Distance    float64 `json:"distance"`
+}
+
+// key identifies a match for de-duplication: the same match is only sent
+// again if its prices change.
+func (m AlertMatch) key(rule AlertRule) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%v|%v", rule.ID, m.Item, m.Station, m.Destination, m.BuyPrice, m.SellPrice)
+}
+
+// alertNotification is the body of a webhook request.
+type alertNotification struct {
+	// ID is unique for each match, so that receivers can ignore the
+	// duplicates caused by retries.
+	ID    string     `json:"id"`
+	Rule  AlertRule  `json:"rule"`
+	Match AlertMatch `json:"match"`
+	Time  time.Time  `json:"time"`
+	// Quoted is the time of the quote that caused the match.
+	Quoted time.Time `json:"quoted"`
+}
+
+// alertRegistry holds the alert rules and delivers their matches.
+type alertRegistry struct {
+	sync.Mutex
+	path  string
+	rules map[string]AlertRule
+	// sent holds the keys of the matches already notified.
+	sent  map[string]bool
+	queue chan alertNotification
+	// routes caches the jumps of each route rule, by rule ID.
+	routes map[string]*jumpCache
+	// unsaved is set when delivered rules haven't been written yet.
+	unsaved bool
+}
+
+func newAlertRegistry() *alertRegistry {
+	return &alertRegistry{
+		rules:  make(map[string]AlertRule),
+		sent:   make(map[string]bool),
+		queue:  make(chan alertNotification, alertQueueSize),
+		routes: make(map[string]*jumpCache),
+	}
+}
+
+// alerts is loaded from the -alerts file when the program starts.
+var alerts = newAlertRegistry()
+
+// load replaces the rules with the ones in the JSON file at path. A missing
+// file leaves the registry empty, and an invalid rule is an error.
+func (a *alertRegistry) load(path string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.path = path
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []AlertRule
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	rules := make(map[string]AlertRule)
+	for i, rule := range list {
+		if rule.ID == "" {
+			return fmt.Errorf("%v: rule %d has no id", path, i)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("%v: rule %v: %v", path, rule.ID, err)
+		}
+		rules[rule.ID] = rule
+	}
+	a.rules = rules
+	a.routes = make(map[string]*jumpCache)
+	return nil
+}
+
+// save writes the rules to their file. The caller must hold the lock.
+func (a *alertRegistry) save() error {
+	if a.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(a.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+	a.unsaved = false
+	return nil
+}
+
+// sorted lists the rules by ID. The caller must hold the lock.
+func (a *alertRegistry) sorted() []AlertRule {
+	list := make([]AlertRule, 0, len(a.rules))
+	for _, rule := range a.rules {
+		list = append(list, rule)
+	}
+	sort.Sort(rulesByID(list))
+	return list
+}
+
+func (a *alertRegistry) put(rule AlertRule) (AlertRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+	if rule.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return rule, err
+		}
+		rule.ID = hex.EncodeToString(id)
+	}
+	a.Lock()
+	defer a.Unlock()
+	if old, ok := a.rules[rule.ID]; ok {
+		rule.Notified = old.Notified
+	}
+	a.rules[rule.ID] = rule
+	delete(a.routes, rule.ID)
+	return rule, a.save()
+}
+
+func (a *alertRegistry) remove(id string) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.rules[id]; !ok {
+		return false, nil
+	}
+	delete(a.rules, id)
+	delete(a.routes, id)
+	return true, a.save()
+}
+
+type rulesByID []AlertRule
+
+func (r rulesByID) Len() int           { return len(r) }
+func (r rulesByID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rulesByID) Less(i, j int) bool { return r[i].ID < r[j].ID }
+
+// check evaluates the rules against a transaction just recorded in s, and
+// queues the new matches for delivery. Only the routes and prices that the
+// transaction can have changed are looked at. The caller must hold the store
+// lock.
+func (a *alertRegistry) check(s *marketStore, t emdn.Transaction) {
+	a.Lock()
+	defer a.Unlock()
+	for _, rule := range a.rules {
+		if !rule.fresh(t) {
+			continue
+		}
+		var matches []AlertMatch
+		switch rule.Kind {
+		case "route":
+			matches = s.alertRouteMatches(rule, t, a.jumpCache(rule))
+		case "price":
+			matches = alertPriceMatches(rule, t)
+		}
+		for _, m := range matches {
+			key := m.key(rule)
+			if a.sent[key] {
+				continue
+			}
+			id := sha1.Sum([]byte(key))
+			n := alertNotification{ID: hex.EncodeToString(id[:8]), Rule: rule, Match: m, Time: time.Now(), Quoted: t.Timestamp}
+			select {
+			case a.queue <- n:
+				if len(a.sent) >= maxSentAlerts {
+					a.sent = make(map[string]bool)
+				}
+				a.sent[key] = true
+			default:
+				log.Printf("alerts: queue full, dropped match for rule %v", rule.ID)
+			}
+		}
+	}
+}
+
+// jumpCache returns the jumps cache of a route rule. The caller must hold
+// the lock.
+func (a *alertRegistry) jumpCache(rule AlertRule) *jumpCache {
+	jc, ok := a.routes[rule.ID]
+	if !ok {
+		jumpRange := rule.JumpRange
+		if jumpRange <= 0 {
+			jumpRange = math.MaxFloat64
+		}
+		jc = newJumpCache(jumpRange, routeConstraints{})
+		a.routes[rule.ID] = jc
+	}
+	return jc
+}
+
+// delivered records that a notification reached its webhook, so that its
+// quote isn't notified again after a restart. The rules are written by
+// flush.
+func (a *alertRegistry) delivered(n alertNotification) {
+	a.Lock()
+	defer a.Unlock()
+	quoted := n.Quoted
+	// A sender's clock running ahead mustn't silence the rule.
+	if now := time.Now(); quoted.After(now) {
+		quoted = now
+	}
+	rule, ok := a.rules[n.Rule.ID]
+	if !ok || !rule.fresh(emdn.Transaction{Timestamp: quoted}) {
+		return
+	}
+	rule.Notified = &quoted
+	a.rules[rule.ID] = rule
+	a.unsaved = true
+}
+
+// flush writes the rules updated by delivered, if any.
+func (a *alertRegistry) flush() {
+	a.Lock()
+	defer a.Unlock()
+	if !a.unsaved {
+		return
+	}
+	if err := a.save(); err != nil {
+		log.Println("alerts:", err)
+	}
+}
+
+// alertRouteMatches finds the routes of a route rule that involve the
+// transaction's station and item: from it if it's a watched origin, or to it
+// from a watched origin. Prices are checked before the jumps, which come
+// from jc.
+func (s marketStore) alertRouteMatches(rule AlertRule, t emdn.Transaction, jc *jumpCache) (matches []AlertMatch) {
+	add := func(from, to string) {
+		supply, demand := s.stationSupply[from][t.Item], s.stationDemand[to][t.Item]
+		if from == to || supply.Supply == 0 || supply.BuyPrice == 0 || supply.BuyPrice == math.MaxInt64 || demand.Demand == 0 {
+			return
+		}
+		profit := demand.SellPrice - supply.BuyPrice
+		if profit < rule.MinProfit {
+			return
+		}
+		if _, ok := jc.route(star(from), star(to)); !ok {
+			return
+		}
+		matches = append(matches, AlertMatch{
+			Item:        t.Item,
+			Station:     from,
+			Destination: to,
+			BuyPrice:    supply.BuyPrice,
+			SellPrice:   demand.SellPrice,
+			Profit:      profit,
+			Distance:    distance(from, to),
+		})
+	}
+	if rule.origin(t.Station) {
+		for to := range s.stationDemand {
+			add(t.Station, to)
+		}
+	}
+	for from := range s.stationSupply {
+		if rule.origin(from) && from != t.Station {
+			add(from, t.Station)
+		}
+	}
+	return matches
+}
+
+// alertPriceMatches checks a price rule against a transaction.
+func alertPriceMatches(rule AlertRule, t emdn.Transaction) []AlertMatch {
+	if t.Item != rule.Item {
+		return nil
+	}
+	var d float64
+	if rule.Near != "" {
+		loc, ok := locs[star(t.Station)]
+		if !ok {
+			return nil
+		}
+		if d = loc.Distance(locs[rule.Near]); rule.Radius > 0 && d > rule.Radius {
+			return nil
+		}
+	}
+	m := AlertMatch{Item: t.Item, Station: t.Station, Distance: d}
+	switch {
+	case rule.SellAbove > 0 && t.Demand > 0 && t.SellPrice > rule.SellAbove:
+		m.SellPrice = t.SellPrice
+	case rule.BuyBelow > 0 && t.Supply > 0 && t.BuyPrice > 0 && t.BuyPrice < rule.BuyBelow:
+		m.BuyPrice = t.BuyPrice
+	default:
+		return nil
+	}
+	return []AlertMatch{m}
+}
+
+// deliver POSTs the queued matches to their webhooks. The delivered quotes
+// are saved whenever the queue runs empty, rather than after each
+// notification.
+func (a *alertRegistry) deliver(client *http.Client) {
+	for n := range a.queue {
+		a.post(client, n)
+		if len(a.queue) == 0 {
+			a.flush()
+		}
+	}
+}
+
+// post delivers one notification. Failed deliveries are retried with a
+// growing wait, unless the webhook rejects the request.
+func (a *alertRegistry) post(client *http.Client, n alertNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Println("alerts:", err)
+		return
+	}
+	wait := *alertRetryWait
+	for attempt := 0; ; attempt++ {
+		retry, err := postAlert(client, n.Rule.webhook(), n.ID, body)
+		if err == nil {
+			a.delivered(n)
+			return
+		}
+		if !retry || attempt >= *alertRetries {
+			log.Printf("alerts: giving up on rule %v: %v", n.Rule.ID, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// postAlert sends one webhook request. It reports whether a failure is worth
+// retrying: network errors and server errors are, other refusals aren't.
+func postAlert(client *http.Client, url, id string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Alert-Id", id)
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook %v: %v", url, resp.Status)
+	}
+	return false, fmt.Errorf("webhook %v: %v", url, resp.Status)
+}
+
+// resolveAlertRule resolves the names in a rule. The caller must hold the
+// store lock.
+func (s marketStore) resolveAlertRule(rule *AlertRule) (err error) {
+	if rule.Station != "" {
+		if rule.Station, err = s.resolveStation(rule.Station); err != nil {
+			return err
+		}
+	}
+	if rule.System != "" {
+		if rule.System, err = resolveSystem(rule.System); err != nil {
+			return err
+		}
+	}
+	if rule.Near != "" {
+		if rule.Near, err = resolveSystem(rule.Near); err != nil {
+			return err
+		}
+	}
+	if rule.Item != "" {
+		if rule.Item, err = s.resolveItem(rule.Item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alertsHandler lists the alert rules on GET, adds or replaces a rule from a
+// JSON body on POST or PUT and removes the rule with the "id" parameter on
+// DELETE.
+func (s marketStore) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		alerts.Lock()
+		list := alerts.sorted()
+		alerts.Unlock()
+		writeJSON(w, http.StatusOK, list)
+	case "POST", "PUT":
+		var rule AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		err := s.resolveAlertRule(&rule)
+		mu.Unlock()
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		if err := rule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule, err = alerts.put(rule)
+		if err != nil {
+			log.Println("alertsHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	case "DELETE":
+		found, err := alerts.remove(r.FormValue("id"))
+		if err != nil {
+			log.Println("alertsHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "alert not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+// withAlerts replaces the global alert registry for the duration of a test,
+// backed by a file in a temporary directory, and delivers its matches.
+func withAlerts(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "eliteprofit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, oldWait := alerts, *alertRetryWait
+	alerts = newAlertRegistry()
+	*alertRetryWait = time.Millisecond
+	path = filepath.Join(dir, "alerts.json")
+	if err := alerts.load(path); err != nil {
+		t.Fatal(err)
+	}
+	go alerts.deliver(http.DefaultClient)
+	return path, func() {
+		close(alerts.queue)
+		alerts, *alertRetryWait = old, oldWait
+		os.RemoveAll(dir)
+	}
+}
+
+// webhookRecorder is a webhook receiver that fails its first request.
+type webhookRecorder struct {
+	sync.Mutex
+	requests int
+	ids      []string
+	received []alertNotification
+}
+
+func (h *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	h.requests++
+	h.ids = append(h.ids, r.Header.Get("X-Alert-Id"))
+	if h.requests == 1 {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var n alertNotification
+	json.NewDecoder(r.Body).Decode(&n)
+	h.received = append(h.received, n)
+}
+
+func TestPriceAlert(t *testing.T) {
+	path, cleanup := withAlerts(t)
+	defer cleanup()
+	store := testStore(t)
+	hook := &webhookRecorder{}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	defer withAdminToken("secret")()
+	post := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		store.alertsHandler(w, r)
+		return w
+	}
+	if w := post(`{"kind": "price", "item": "consumertechnology", "sellAbove": 100000, "near": "eranin", "radius": 20, "webhook": "` + ts.URL + `"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d %q", w.Code, w.Body)
+	}
+	if w := post(`{"kind": "price", "item": "Bogus", "sellAbove": 1, "webhook": "` + ts.URL + `"}`); w.Code != http.StatusNotFound {
+		t.Errorf("POST with an unknown item: got %d", w.Code)
+	}
+	if w := post(`{"kind": "weather", "webhook": "` + ts.URL + `"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with an unknown kind: got %d", w.Code)
+	}
+
+	// The rule survives a restart.
+	reloaded := newAlertRegistry()
+	if err := reloaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.rules) != 1 {
+		t.Fatalf("reloaded %d rules, wanted 1", len(reloaded.rules))
+	}
+
+	tr := emdn.Transaction{Item: "consumertechnology", Station: "Eranin (AZEBAN CITY)", SellPrice: 200000, Demand: 10}
+	store.record(tr)
+	// The same quote again isn't notified twice.
+	store.record(tr)
+	// Too cheap.
+	store.record(emdn.Transaction{Item: "consumertechnology", Station: "Eranin (AZEBAN CITY)", SellPrice: 50, Demand: 10})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hook.Lock()
+		n := len(hook.received)
+		hook.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	hook.Lock()
+	defer hook.Unlock()
+	if len(hook.received) != 1 || hook.received[0].Match.SellPrice != 200000 {
+		t.Fatalf("received %+v, wanted one notification", hook.received)
+	}
+	if hook.requests != 2 || hook.ids[0] != hook.ids[1] || hook.ids[0] == "" {
+		t.Errorf("got %d requests with ids %q, wanted a retry with the same id", hook.requests, hook.ids)
+	}
+}
+
+func TestRouteAlertMatches(t *testing.T) {
+	store := testStore(t)
+	// Find a station buying something, and offer it cheaply in Eranin.
+	var item, buyer string
+	var price float64
+	for station, demand := range store.stationDemand {
+		if star(station) == "Eranin" {
+			continue
+		}
+		for i, d := range demand {
+			if d.Demand > 0 && d.SellPrice > price {
+				item, buyer, price = i, station, d.SellPrice
+			}
+		}
+	}
+	if item == "" {
+		t.Fatal("no demand in the test data")
+	}
+	rule := AlertRule{ID: "r", Kind: "route", System: "Eranin", MinProfit: 1000}
+	tr := emdn.Transaction{Item: item, Station: "Eranin (AZEBAN CITY)", BuyPrice: price - 1500, Supply: 100}
+	store.record(tr)
+	found := false
+	for _, m := range store.alertRouteMatches(rule, tr, newJumpCache(math.MaxFloat64, routeConstraints{})) {
+		if m.Profit < rule.MinProfit || m.Station != tr.Station {
+			t.Errorf("unexpected match %+v", m)
+		}
+		if m.Destination == buyer {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no match for the route to %v", buyer)
+	}
+	rule.MinProfit = 2000
+	for _, m := range store.alertRouteMatches(rule, tr, newJumpCache(math.MaxFloat64, routeConstraints{})) {
+		if m.Destination == buyer {
+			t.Errorf("route to %v below the minimum profit matched: %+v", buyer, m)
+		}
+	}
+}
+
+func TestReplayedAlert(t *testing.T) {
+	path, cleanup := withAlerts(t)
+	defer cleanup()
+	store := testStore(t)
+	hook := &webhookRecorder{}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+	if _, err := alerts.put(AlertRule{Kind: "price", Item: "gold", SellAbove: 100000, Webhook: ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	quoted := time.Date(2014, 8, 22, 20, 0, 0, 0, time.UTC)
+	tr := emdn.Transaction{Item: "gold", Station: "Eranin (AZEBAN CITY)", SellPrice: 200000, Demand: 10, Timestamp: quoted}
+	store.record(tr)
+	// After a restart, the cache replays the same quote.
+	restarted := newAlertRegistry()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := restarted.load(path); err != nil {
+			t.Fatal(err)
+		}
+		if notified := restarted.sorted()[0].Notified; notified != nil {
+			if !notified.Equal(quoted) {
+				t.Fatalf("notified up to %v, want %v", notified, quoted)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("notification not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted.check(store, tr)
+	if n := len(restarted.queue); n != 0 {
+		t.Errorf("replayed quote queued %d notifications, want none", n)
+	}
+	tr.Timestamp = quoted.Add(time.Minute)
+	restarted.check(store, tr)
+	if n := len(restarted.queue); n != 1 {
+		t.Errorf("newer quote queued %d notifications, want 1", n)
+	}
+}
+
+func TestFutureAlertQuote(t *testing.T) {
+	a := newAlertRegistry()
+	rule := AlertRule{ID: "a", Kind: "price", Item: "gold", SellAbove: 100000, Webhook: "http://localhost/"}
+	a.rules[rule.ID] = rule
+	// A sender whose clock is a day ahead.
+	a.delivered(alertNotification{Rule: rule, Quoted: time.Now().Add(24 * time.Hour)})
+	if notified := a.rules[rule.ID].Notified; notified == nil || notified.After(time.Now()) {
+		t.Fatalf("notified up to %v, want no later than now", notified)
+	}
+	if !a.rules[rule.ID].fresh(emdn.Transaction{Timestamp: time.Now().Add(time.Second)}) {
+		t.Error("quote after the skewed one isn't checked")
+	}
+}
+
+func TestFullAlertQueue(t *testing.T) {
+	a := newAlertRegistry()
+	a.rules["a"] = AlertRule{ID: "a", Kind: "price", Item: "gold", SellAbove: 100000, Webhook: "http://localhost/"}
+	tr := emdn.Transaction{Item: "gold", Station: "Eranin (AZEBAN CITY)", SellPrice: 200000, Demand: 10}
+	// Nobody is receiving, so the match is dropped.
+	a.queue = make(chan alertNotification)
+	a.check(newMarketStore(), tr)
+	a.queue = make(chan alertNotification, 1)
+	a.check(newMarketStore(), tr)
+	if n := len(a.queue); n != 1 {
+		t.Errorf("dropped match queued %d notifications when it matched again, want 1", n)
+	}
+}
+
+func TestLoadInvalidAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eliteprofit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.json")
+	for _, rules := range []string{
+		`[{"id": "a", "kind": "weather", "webhook": "http://localhost/"}]`,
+		`[{"id": "a", "kind": "price", "item": "gold", "sellAbove": 1, "webhook": "file:///etc/passwd"}]`,
+		`[{"id": "a", "kind": "price", "item": "gold", "sellAbove": -1, "buyBelow": 5, "webhook": "http://localhost/"}]`,
+		`[{"id": "a", "kind": "route", "system": "Eranin", "minProfit": 0, "webhook": "http://localhost/"}]`,
+		`[{"kind": "route", "system": "Eranin", "minProfit": 100, "webhook": "http://localhost/"}]`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := newAlertRegistry().load(path); err == nil {
+			t.Errorf("loaded %v", rules)
+		}
+	}
+}
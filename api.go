@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The JSON API serves the same queries as the text views under /api/v1/,
+// e.g. /api/v1/bestbuy?station=azeban, with the same parameters. Field names
+// are part of the API and must not change within a version.
+
+// apiQueries maps the API endpoints to their queries. The queries run with
+// the lock held.
+var apiQueries = map[string]func(s *marketStore, r *http.Request) (interface{}, error){
+	"bestbuy": func(s *marketStore, r *http.Request) (interface{}, error) {
+		if r.FormValue("all") != "" {
+			return s.queryAllOrigins(r)
+		}
+		return s.queryBestBuy(r)
+	},
+	"bestsell":   func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryBestSell(r) },
+	"source":     func(s *marketStore, r *http.Request) (interface{}, error) { return s.querySource(r) },
+	"nearby":     func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryNearby(r) },
+	"search":     func(s *marketStore, r *http.Request) (interface{}, error) { return s.querySearch(r) },
+	"loops":      func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryLoops(r) },
+	"plan":       func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryPlan(r) },
+	"route":      func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryRoute(r) },
+	"categories": func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryCategories(r) },
+	"impact":     func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryImpact(r) },
+	"coverage":   func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryCoverage(r) },
+	"stats":      func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryStats(r) },
+	"buy":        func(s *marketStore, r *http.Request) (interface{}, error) { return s.queryBuy(r) },
+	"sell":       func(s *marketStore, r *http.Request) (interface{}, error) { return s.querySell(r) },
+}
+
+// apiHandler serves the JSON API.
+func (s marketStore) apiHandler(w http.ResponseWriter, r *http.Request) {
+	query, ok := apiQueries[strings.TrimPrefix(r.URL.Path, "/api/v1/")]
+	if !ok {
+		writeAPIError(w, &statusError{http.StatusNotFound, "unknown API endpoint " + r.URL.Path})
+		return
+	}
+	mu.Lock()
+	v, err := query(&s, r)
+	mu.Unlock()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// allOriginsResult is the JSON report of all origins.
+type allOriginsResult struct {
+	Computed time.Time       `json:"computed"`
+	Stations json.RawMessage `json:"stations"`
+}
+
+func (s marketStore) queryAllOrigins(r *http.Request) (res allOriginsResult, err error) {
+	text, computed, err := s.allOriginsReport(r, "json", func(w io.Writer, q routeQuery, origins []StationRoutes) {
+		json.NewEncoder(w).Encode(origins)
+	})
+	if err != nil {
+		return res, err
+	}
+	return allOriginsResult{Computed: computed, Stations: text}, nil
+}
+
+// apiError is the JSON form of an error.
+type apiError struct {
+	Status      int      `json:"status"`
+	Message     string   `json:"message"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	e := apiError{Status: errorStatus(err), Message: err.Error()}
+	if ne, ok := err.(*nameError); ok {
+		e.Suggestions = ne.Suggestions
+	}
+	if e.Status == http.StatusAccepted {
+		w.Header().Set("Retry-After", "10")
+	}
+	writeJSON(w, e.Status, struct {
+		Error apiError `json:"error"`
+	}{e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("writeJSON:", err)
+	}
+}
+
+// MarshalJSON adds the figures derived from a route to its JSON form.
+func (r Route) MarshalJSON() ([]byte, error) {
+	type route Route
+	return json.Marshal(struct {
+		route
+		JumpCount     int     `json:"jumpCount"`
+		CRJump        float64 `json:"crJump"`
+		CRHour        float64 `json:"crHour"`
+		TravelSeconds float64 `json:"travelSeconds"`
+	}{route(r), r.JumpCount(), r.CRJump(), r.CRHour(), r.Travel.Seconds()})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func apiGet(t *testing.T, store *marketStore, url string, v interface{}) int {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	store.apiHandler(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v: Content-Type %q", url, ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%v: %v in %q", url, err, w.Body)
+	}
+	return w.Code
+}
+
+func TestAPIBestBuy(t *testing.T) {
+	store := testStore(t)
+	var res struct {
+		Stations []struct {
+			Station string
+			Routes  []map[string]interface{}
+		}
+	}
+	if code := apiGet(t, store, "/api/v1/bestbuy?station=azeban&jr=100", &res); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(res.Stations) != 1 || res.Stations[0].Station != "Eranin (AZEBAN CITY)" || len(res.Stations[0].Routes) == 0 {
+		t.Fatalf("got %+v", res)
+	}
+	route := res.Stations[0].Routes[0]
+	for _, field := range []string{"item", "destinationStation", "totalProfit", "jumps", "jumpCount", "crJump", "travelSeconds"} {
+		if _, ok := route[field]; !ok {
+			t.Errorf("route without field %q: %v", field, route)
+		}
+	}
+
+	// The text view shows the same route.
+	r, _ := http.NewRequest("GET", "/bestbuy?station=azeban&jr=100", nil)
+	w := httptest.NewRecorder()
+	store.bestBuyHandler(w, r)
+	if dest := route["destinationStation"].(string); !strings.Contains(w.Body.String(), "sell to "+dest) {
+		t.Errorf("text view doesn't mention %v: %q", dest, w.Body)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	store := testStore(t)
+	defer func(old *reportCache) { reports = old }(reports)
+	reports = newReportCache(*reportMaxAge)
+	var tests = []struct {
+		url        string
+		status     int
+		suggestion bool
+	}{
+		{"/api/v1/bestbuy?station=Erannin", http.StatusNotFound, true},
+		{"/api/v1/bestbuy", http.StatusBadRequest, false},
+		{"/api/v1/bestsell?station=azeban", http.StatusBadRequest, false},
+		{"/api/v1/bestsell?item=consumertechnology", http.StatusBadRequest, false},
+		{"/api/v1/plan?cr=1000", http.StatusBadRequest, false},
+		{"/api/v1/source?item=consumertechnology", http.StatusBadRequest, false},
+		{"/api/v1/bogus", http.StatusNotFound, false},
+		// Computed in the background, then served from the cache.
+		{"/api/v1/bestbuy?all=1&jr=7", http.StatusAccepted, false},
+	}
+	for _, test := range tests {
+		var res struct {
+			Error apiError
+		}
+		if code := apiGet(t, store, test.url, &res); code != test.status || res.Error.Status != test.status {
+			t.Errorf("%v: got status %d, error %+v; wanted %d", test.url, code, res.Error, test.status)
+		}
+		if res.Error.Message == "" || (len(res.Error.Suggestions) > 0) != test.suggestion {
+			t.Errorf("%v: got error %+v", test.url, res.Error)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+// backtestTrade is a route taken during a backtest, waiting for the market
+// time of its arrival.
+type backtestTrade struct {
+	Strategy string
+	Route    Route
+	Arrival  time.Time
+}
+
+// BacktestResult sums up the trades recommended by one strategy.
+type BacktestResult struct {
+	Strategy string
+	Trades   int
+	// Held counts the trades whose destination still paid at least the
+	// predicted price on arrival.
+	Held int
+	// Predicted and Realized are the total profits expected when the routes
+	// were taken and obtained on arrival.
+	Predicted float64
+	Realized  float64
+	// Travelling counts the trades that hadn't arrived when the archive
+	// ended. They're not part of the totals.
+	Travelling int
+}
+
+// backtester replays an archive through a marketStore. Every interval of
+// market time, it takes the best route from each origin for every registered
+// strategy. When the market time passes the arrival of a route, the
+// cargo is sold at the destination's latest quote.
+type backtester struct {
+	store    *marketStore
+	q        routeQuery
+	jc       *jumpCache
+	origins  []string
+	interval time.Duration
+	next     time.Time
+	trades   []backtestTrade
+	results  map[string]*BacktestResult
+}
+
+// newBacktester prepares a backtest of the route searches from origins, or
+// from every station if there are none. Origins may be partial names.
+func newBacktester(q routeQuery, origins []string, interval time.Duration) *backtester {
+	b := &backtester{
+		store:    newMarketStore(),
+		q:        q,
+		jc:       newJumpCache(q.JumpRange, q.Constraints),
+		origins:  origins,
+		interval: interval,
+		results:  make(map[string]*BacktestResult),
+	}
+	for order := range strategies {
+		b.results[order] = &BacktestResult{Strategy: order}
+	}
+	return b
+}
+
+// replay feeds one quote to the store. Trades that arrived before the quote
+// are settled first, so they only see the quotes known on arrival.
+func (b *backtester) replay(t emdn.Transaction) {
+	b.settle(t.Timestamp)
+	b.store.record(t)
+	if b.next.IsZero() {
+		// Give the store some time to fill up.
+		b.next = t.Timestamp.Add(b.interval)
+	} else if !t.Timestamp.Before(b.next) {
+		b.recommend(t.Timestamp)
+		b.next = t.Timestamp.Add(b.interval)
+	}
+}
+
+// recommend takes the best route of every strategy from every origin.
+func (b *backtester) recommend(now time.Time) {
+	origins := b.origins
+	if len(origins) == 0 {
+		for station := range b.store.stationSupply {
+			origins = append(origins, station)
+		}
+		sort.Strings(origins)
+	}
+	for _, name := range origins {
+		station, err := b.store.resolveStation(name)
+		if err != nil {
+			// Not quoted yet.
+			continue
+		}
+		q := b.q
+		q.Station = station
+		routes := b.store.candidateRoutes(q, b.jc)
+		if len(routes) == 0 {
+			continue
+		}
+		for order := range strategies {
+			sortRoutes(routes, order)
+			b.trades = append(b.trades, backtestTrade{order, routes[0], now.Add(routes[0].Travel)})
+		}
+	}
+}
+
+// settle sells the cargo of the trades that arrived before now.
+func (b *backtester) settle(now time.Time) {
+	kept := b.trades[:0]
+	for _, t := range b.trades {
+		if !t.Arrival.Before(now) {
+			kept = append(kept, t)
+			continue
+		}
+		realized, held := b.realize(t.Route)
+		res := b.results[t.Strategy]
+		res.Trades++
+		if held {
+			res.Held++
+		}
+		res.Predicted += t.Route.TotalProfit
+		res.Realized += realized
+	}
+	b.trades = kept
+}
+
+// realize is the profit of selling a route's cargo at the destination's
+// current quote, and whether the price was at least the predicted one. The
+// cargo was paid when the route was taken.
+func (b *backtester) realize(r Route) (profit float64, held bool) {
+	d, ok := b.store.stationDemand[r.DestinationStation][r.Item]
+	if !ok {
+		return -r.Outlay, false
+	}
+	n := r.Units
+	if d.Demand < n {
+		n = d.Demand
+	}
+	tr := b.store.newTrade(r.Item, emdn.Transaction{}, d)
+	return tr.revenue(0, n) - r.Outlay, d.SellPrice >= r.SellPrice
+}
+
+// Results lists the result of each strategy by name. Trades still travelling
+// are counted separately.
+func (b *backtester) Results() []BacktestResult {
+	var results []BacktestResult
+	for _, res := range b.results {
+		results = append(results, *res)
+	}
+	for _, t := range b.trades {
+		for i := range results {
+			if results[i].Strategy == t.Strategy {
+				results[i].Travelling++
+			}
+		}
+	}
+	sort.Sort(backtestResultsByStrategy(results))
+	return results
+}
+
+type backtestResultsByStrategy []BacktestResult
+
+func (r backtestResultsByStrategy) Len() int           { return len(r) }
+func (r backtestResultsByStrategy) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r backtestResultsByStrategy) Less(i, j int) bool { return r[i].Strategy < r[j].Strategy }
+
+// percent is a as a percentage of b, or zero if b is zero.
+func percent(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return 100 * a / b
+}
+
+func writeBacktestResults(w io.Writer, results []BacktestResult) {
+	for _, res := range results {
+		fmt.Fprintf(w, "%-8v %5d trades, prices held %3.0f%%, predicted profit %.0f, realized profit %.0f (%.0f%%), still travelling %d\n",
+			res.Strategy, res.Trades, percent(float64(res.Held), float64(res.Trades)),
+			res.Predicted, res.Realized, percent(res.Realized, res.Predicted), res.Travelling)
+	}
+}
+
+// backtestCommand runs "eliteprofit backtest [flags] archive" and writes the
+// report to w.
+func backtestCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Hour, "Market time between route recommendations")
+	stations := fs.String("stations", "", "Comma-separated origin stations; all stations if empty")
+	cr := fs.Float64("cr", 0, "Credits available for each trade; unlimited if zero")
+	jr := fs.Float64("jr", 0, "Jump range in LY; unlimited if zero")
+	cargo := fs.Int("cargo", 1, "Cargo capacity in tons")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: eliteprofit backtest [flags] archive")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("backtest: -interval must be positive")
+	}
+	q := routeQuery{CreditLimit: *cr, JumpRange: *jr, Cargo: *cargo}
+	if q.CreditLimit <= 0 {
+		q.CreditLimit = math.MaxFloat64
+	}
+	if q.JumpRange <= 0 {
+		q.JumpRange = math.MaxFloat64
+	}
+	if q.Cargo <= 0 {
+		q.Cargo = 1
+	}
+	var origins []string
+	if *stations != "" {
+		origins = strings.Split(*stations, ",")
+	}
+	messages, err := emdn.ArchiveRead(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b := newBacktester(q, origins, *interval)
+	for m := range messages {
+		b.replay(m.Transaction)
+	}
+	writeBacktestResults(w, b.Results())
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestBacktest(t *testing.T) {
+	t0 := time.Date(2014, 8, 22, 20, 0, 0, 0, time.UTC)
+	source, destination := "Eranin (AZEBAN CITY)", "Asellus Primus (BEAGLE 2 LANDING)"
+	q := routeQuery{CreditLimit: math.MaxFloat64, JumpRange: 100, Cargo: 10}
+	b := newBacktester(q, []string{"azeban"}, time.Hour)
+	for _, m := range []emdn.Transaction{
+		{Station: source, Item: "gold", BuyPrice: 100, Supply: 1000, Timestamp: t0},
+		{Station: destination, Item: "gold", SellPrice: 300, Demand: 1000, Timestamp: t0},
+		// Takes the route.
+		{Station: source, Item: "gold", BuyPrice: 100, Supply: 1000, Timestamp: t0.Add(time.Hour)},
+		// The price drops before the cargo arrives.
+		{Station: destination, Item: "gold", SellPrice: 150, Demand: 1000, Timestamp: t0.Add(time.Hour + time.Second)},
+		// Arrived. Takes the route again, which hasn't arrived at the end.
+		{Station: source, Item: "gold", BuyPrice: 100, Supply: 1000, Timestamp: t0.Add(3 * time.Hour)},
+	} {
+		b.replay(m)
+	}
+	results := b.Results()
+	if len(results) != len(strategies) {
+		t.Fatalf("got %d results, want one for each of the %d strategies", len(results), len(strategies))
+	}
+	for _, res := range results {
+		if res.Trades != 1 || res.Held != 0 || res.Travelling != 1 {
+			t.Errorf("%v: got %+v, want one trade whose price didn't hold and one travelling", res.Strategy, res)
+		}
+		if res.Predicted < 1900 || res.Predicted > 2000 {
+			t.Errorf("%v: predicted profit %v, want about 10 * 200", res.Strategy, res.Predicted)
+		}
+		if res.Realized < 400 || res.Realized > 500 {
+			t.Errorf("%v: realized profit %v, want about 10 * 50", res.Strategy, res.Realized)
+		}
+	}
+}
+
+func TestBacktestCommand(t *testing.T) {
+	var buf bytes.Buffer
+	args := []string{"-interval", "1m", "-cargo", "4", filepath.Join("data", "input.json")}
+	if err := backtestCommand(args, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for order := range strategies {
+		if !strings.Contains(buf.String(), order+" ") {
+			t.Errorf("no result for strategy %q in:\n%v", order, buf.String())
+		}
+	}
+	if err := backtestCommand(nil, &buf); err == nil {
+		t.Error("no error without an archive")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// categoryNames lists every item category seen.
+func (s marketStore) categoryNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, category := range s.itemCategory {
+		if !seen[category] {
+			seen[category] = true
+			names = append(names, category)
+		}
+	}
+	return names
+}
+
+func (s marketStore) resolveCategory(name string) (string, error) {
+	return resolveName("category", name, s.categoryNames())
+}
+
+// parseCategories reads a comma-separated list of categories. Unless strict,
+// names matching no category seen yet are ignored: excluding a category
+// that isn't traded excludes nothing.
+func (s marketStore) parseCategories(list string, strict bool) (map[string]bool, error) {
+	var categories map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		category, err := s.resolveCategory(name)
+		if e, ok := err.(*nameError); ok && !strict && !e.Ambiguous {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if categories == nil {
+			categories = make(map[string]bool)
+		}
+		categories[category] = true
+	}
+	return categories, nil
+}
+
+// Spread is the difference between the cheapest station selling an item and
+// the station paying the most for it, anywhere in the galaxy.
+type Spread struct {
+	Item        string  `json:"item"`
+	BuyStation  string  `json:"buyStation"`
+	BuyPrice    float64 `json:"buyPrice"`
+	SellStation string  `json:"sellStation"`
+	SellPrice   float64 `json:"sellPrice"`
+	Spread      float64 `json:"spread"`
+}
+
+// CategorySummary sums up the trade opportunities of a category.
+type CategorySummary struct {
+	Category string `json:"category"`
+	Items    int    `json:"items"`
+	// Best are the widest spreads among the category's items.
+	Best []Spread `json:"best"`
+}
+
+// spread computes the best galactic spread of an item. It's false if the item
+// isn't both sold and bought somewhere.
+func (s marketStore) spread(item string) (Spread, bool) {
+	supply, demand := s.minSupply(item), s.maxDemand(item)
+	if supply.Station == "" || demand.Station == "" || supply.BuyPrice == math.MaxInt64 || supply.Supply == 0 || demand.Demand == 0 {
+		return Spread{}, false
+	}
+	return Spread{
+		Item:        item,
+		BuyStation:  supply.Station,
+		BuyPrice:    supply.BuyPrice,
+		SellStation: demand.Station,
+		SellPrice:   demand.SellPrice,
+		Spread:      demand.SellPrice - supply.BuyPrice,
+	}, true
+}
+
+// categorySummaries sums up the categories allowed by q, listing the n best
+// spreads of each.
+func (s marketStore) categorySummaries(q routeQuery, n int) []CategorySummary {
+	byCategory := make(map[string]*CategorySummary)
+	for item, category := range s.itemCategory {
+		if !q.allowsCategory(category) {
+			continue
+		}
+		c, ok := byCategory[category]
+		if !ok {
+			c = &CategorySummary{Category: category, Best: []Spread{}}
+			byCategory[category] = c
+		}
+		c.Items++
+		if sp, ok := s.spread(item); ok {
+			c.Best = append(c.Best, sp)
+		}
+	}
+	summaries := make([]CategorySummary, 0, len(byCategory))
+	for _, c := range byCategory {
+		sort.Sort(spreadsByWidth(c.Best))
+		if n > 0 && len(c.Best) > n {
+			c.Best = c.Best[:n]
+		}
+		summaries = append(summaries, *c)
+	}
+	sort.Sort(categoriesBySpread(summaries))
+	return summaries
+}
+
+type spreadsByWidth []Spread
+
+func (s spreadsByWidth) Len() int      { return len(s) }
+func (s spreadsByWidth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s spreadsByWidth) Less(i, j int) bool {
+	if s[i].Spread != s[j].Spread {
+		return s[i].Spread > s[j].Spread
+	}
+	return s[i].Item < s[j].Item
+}
+
+// categoriesBySpread puts the categories with the widest spread first.
+type categoriesBySpread []CategorySummary
+
+func (c categoriesBySpread) Len() int      { return len(c) }
+func (c categoriesBySpread) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c categoriesBySpread) Less(i, j int) bool {
+	a, b := math.Inf(-1), math.Inf(-1)
+	if len(c[i].Best) > 0 {
+		a = c[i].Best[0].Spread
+	}
+	if len(c[j].Best) > 0 {
+		b = c[j].Best[0].Spread
+	}
+	if a != b {
+		return a > b
+	}
+	return c[i].Category < c[j].Category
+}
+
+// categoriesResult is the result of a /categories query.
+type categoriesResult struct {
+	Categories []CategorySummary `json:"categories"`
+}
+
+func (s marketStore) queryCategories(r *http.Request) (res categoriesResult, err error) {
+	q, err := s.parseRouteQuery(r)
+	if err != nil {
+		return res, err
+	}
+	n, _ := strconv.Atoi(r.FormValue("n"))
+	if n <= 0 {
+		n = 3
+	}
+	res.Categories = s.categorySummaries(q, n)
+	return res, nil
+}
+
+// categoriesHandler shows the best spreads of each item category.
+func (s marketStore) categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryCategories(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	for _, c := range res.Categories {
+		fmt.Fprintf(w, "======== %v, %d items =======\n", c.Category, c.Items)
+		for i, sp := range c.Best {
+			fmt.Fprintf(w, "%d. %v: buy at %v for %v, sell to %v for %v, spread %v\n", i+1, sp.Item, sp.BuyStation, sp.BuyPrice, sp.SellStation, sp.SellPrice, sp.Spread)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
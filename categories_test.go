@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCategoryFilter(t *testing.T) {
+	store := testStore(t)
+	q := routeQuery{Station: "Eranin (AZEBAN CITY)", CreditLimit: 2000000, JumpRange: 100, Cargo: 1}
+	all, _ := store.bestBuy(q)
+	foods := 0
+	for _, r := range all {
+		if r.Category == "" {
+			t.Errorf("route without a category: %+v", r)
+		}
+		if r.Category == "foods" {
+			foods++
+		}
+	}
+	if foods == 0 {
+		t.Fatalf("no foods routes to test with")
+	}
+
+	q.Categories = map[string]bool{"foods": true}
+	routes, _ := store.bestBuy(q)
+	if len(routes) != foods {
+		t.Errorf("category=foods: got %d routes, wanted %d", len(routes), foods)
+	}
+	for _, r := range routes {
+		if r.Category != "foods" {
+			t.Errorf("category=foods: got %v route", r.Category)
+		}
+	}
+
+	q.Categories, q.Exclude = nil, map[string]bool{"foods": true}
+	routes, _ = store.bestBuy(q)
+	if len(routes) != len(all)-foods {
+		t.Errorf("exclude=foods: got %d routes, wanted %d", len(routes), len(all)-foods)
+	}
+	for _, r := range routes {
+		if r.Category == "foods" {
+			t.Errorf("exclude=foods: got %+v", r)
+		}
+	}
+}
+
+func TestParseCategories(t *testing.T) {
+	store := testStore(t)
+	got, err := store.parseCategories("Metal, drugs", true)
+	if err != nil || len(got) != 2 || !got["metals"] || !got["drugs"] {
+		t.Errorf("parseCategories = %v, %v", got, err)
+	}
+	if _, err := store.parseCategories("bogus", true); err == nil {
+		t.Errorf("parseCategories(bogus) succeeded")
+	}
+	if got, err := store.parseCategories("bogus, drugs", false); err != nil || len(got) != 1 || !got["drugs"] {
+		t.Errorf("parseCategories(bogus, drugs) not strict = %v, %v; want drugs", got, err)
+	}
+	if got, err := store.parseCategories("", true); got != nil || err != nil {
+		t.Errorf("parseCategories() = %v, %v", got, err)
+	}
+	r, _ := http.NewRequest("GET", "/bestbuy?station=azeban&exclude=bogus", nil)
+	if _, err := store.queryBestBuy(r); err != nil {
+		t.Errorf("exclude=bogus: got error %v", err)
+	}
+}
+
+func TestCategorySummaries(t *testing.T) {
+	store := testStore(t)
+	summaries := store.categorySummaries(routeQuery{Exclude: map[string]bool{"waste": true}}, 2)
+	if len(summaries) == 0 {
+		t.Fatal("no summaries")
+	}
+	for i, c := range summaries {
+		if c.Category == "waste" {
+			t.Errorf("excluded category listed")
+		}
+		if len(c.Best) > 2 {
+			t.Errorf("%v: %d spreads, wanted at most 2", c.Category, len(c.Best))
+		}
+		for j := 1; j < len(c.Best); j++ {
+			if c.Best[j].Spread > c.Best[j-1].Spread {
+				t.Errorf("%v: spreads out of order: %+v", c.Category, c.Best)
+			}
+		}
+		if i > 0 && len(c.Best) > 0 && len(summaries[i-1].Best) > 0 && c.Best[0].Spread > summaries[i-1].Best[0].Spread {
+			t.Errorf("categories out of order at %v", c.Category)
+		}
+	}
+}
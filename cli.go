@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+// A command answers a question from the terminal and exits, without starting
+// the HTTP server or the EMDN subscription. args excludes the command name.
+type command func(args []string, w io.Writer) error
+
+// commands are run with "eliteprofit [flags] <command> [command flags]".
+var commands = map[string]command{
+	"backtest": backtestCommand,
+	"route":    routeCommand,
+	"best":     bestCommand,
+	"prices":   pricesCommand,
+}
+
+// Ship is a stock ship's cargo capacity and laden jump range.
+type Ship struct {
+	Cargo     int
+	JumpRange float64
+}
+
+// ships are the ship types known to the -ship flag, with approximate stock
+// figures. -cargo and -jr override them.
+var ships = map[string]Ship{
+	"sidewinder": {4, 7.5},
+	"eagle":      {6, 6.5},
+	"hauler":     {16, 8.5},
+	"cobra":      {36, 9.5},
+	"type6":      {100, 8},
+	"type9":      {440, 6.5},
+}
+
+// queryCommand holds the flags shared by the query commands.
+type queryCommand struct {
+	fs      *flag.FlagSet
+	json    *bool
+	archive *string
+	params  url.Values
+}
+
+func newQueryCommand(name string) *queryCommand {
+	c := &queryCommand{fs: flag.NewFlagSet(name, flag.ExitOnError), params: make(url.Values)}
+	c.json = c.fs.Bool("json", false, "Print the result as JSON, like /api/v1/")
+	c.archive = c.fs.String("archive", "", "Market data to load; data/large.gz, or data/input.json with -test, if empty")
+	return c
+}
+
+// param defines a string flag that is passed as a query parameter of the same
+// name, unless it's empty.
+func (c *queryCommand) param(name, usage string) {
+	c.fs.Var(paramFlag{c.params, name}, name, usage)
+}
+
+// paramFlag sets a query parameter.
+type paramFlag struct {
+	params url.Values
+	name   string
+}
+
+func (p paramFlag) String() string {
+	if p.params == nil {
+		return ""
+	}
+	return p.params.Get(p.name)
+}
+
+func (p paramFlag) Set(v string) error {
+	p.params.Set(p.name, v)
+	return nil
+}
+
+// load reads the archive into a new store.
+func (c *queryCommand) load() (*marketStore, error) {
+	path := *c.archive
+	if path == "" {
+		path = filepath.Join("data", "large.gz")
+		if *test {
+			path = filepath.Join("data", "input.json")
+		}
+	}
+	messages, err := emdn.ArchiveRead(path)
+	if err != nil {
+		return nil, err
+	}
+	store := newMarketStore()
+	for m := range messages {
+		store.record(m.Transaction)
+	}
+	return store, nil
+}
+
+// run answers the query of an API endpoint, printed as JSON or by the
+// endpoint's text handler.
+func (c *queryCommand) run(s *marketStore, endpoint string, handler http.HandlerFunc, w io.Writer) error {
+	r, err := http.NewRequest("GET", "/"+endpoint+"?"+c.params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if *c.json {
+		mu.Lock()
+		v, err := apiQueries[endpoint](s, r)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	tw := &terminalWriter{header: make(http.Header), status: http.StatusOK}
+	handler(tw, r)
+	if tw.status >= http.StatusBadRequest {
+		return fmt.Errorf("%v", strings.TrimSpace(tw.body.String()))
+	}
+	_, err = tw.body.WriteTo(w)
+	return err
+}
+
+// terminalWriter collects the output of a text handler.
+type terminalWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (t *terminalWriter) Header() http.Header         { return t.header }
+func (t *terminalWriter) WriteHeader(status int)      { t.status = status }
+func (t *terminalWriter) Write(b []byte) (int, error) { return t.body.Write(b) }
+
+// routeCommand shows the jumps between two systems. It needs no market data.
+func routeCommand(args []string, w io.Writer) error {
+	c := newQueryCommand("route")
+	c.param("from", "System to start from")
+	c.param("to", "Destination system")
+	c.param("jr", "Jump range in LY; unlimited if empty")
+	c.param("avoid", "Comma-separated systems to avoid")
+	c.param("via", "Comma-separated systems to visit on the way")
+	c.fs.Parse(args)
+	s := newMarketStore()
+	return c.run(s, "route", s.routeHandler, w)
+}
+
+// bestCommand shows the best routes from a station, like /bestbuy.
+func bestCommand(args []string, w io.Writer) error {
+	c := newQueryCommand("best")
+	ship := c.fs.String("ship", "", "Ship type, setting the default cargo and jump range: one of "+strings.Join(shipNames(), ", "))
+	c.param("station", "Station to buy from")
+	c.param("system", "System whose stations to buy from")
+	c.param("cr", "Credit limit; unlimited if empty")
+	c.param("cargo", "Cargo capacity in tons")
+	c.param("jr", "Jump range in LY; unlimited if empty")
+	c.param("sort", "Strategy ranking the routes: one of "+strings.Join(strategyNames(), ", "))
+	c.param("category", "Comma-separated item categories to carry")
+	c.param("exclude", "Comma-separated item categories not to carry")
+	c.param("n", "Number of routes shown")
+	c.fs.Parse(args)
+	if *ship != "" {
+		sh, ok := ships[strings.ToLower(*ship)]
+		if !ok {
+			return fmt.Errorf("unknown ship %q, want one of %v", *ship, strings.Join(shipNames(), ", "))
+		}
+		if c.params.Get("cargo") == "" {
+			c.params.Set("cargo", strconv.Itoa(sh.Cargo))
+		}
+		if c.params.Get("jr") == "" {
+			c.params.Set("jr", strconv.FormatFloat(sh.JumpRange, 'f', -1, 64))
+		}
+	}
+	s, err := c.load()
+	if err != nil {
+		return err
+	}
+	return c.run(s, "bestbuy", s.bestBuyHandler, w)
+}
+
+// pricesCommand shows the price statistics of items, like /stats.
+func pricesCommand(args []string, w io.Writer) error {
+	c := newQueryCommand("prices")
+	c.param("item", "Item whose prices at every station are shown")
+	c.param("station", "Station whose prices are shown")
+	c.fs.Parse(args)
+	s, err := c.load()
+	if err != nil {
+		return err
+	}
+	return c.run(s, "stats", s.statsHandler, w)
+}
+
+func shipNames() []string {
+	var names []string
+	for name := range ships {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRouteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	if err := routeCommand([]string{"-from", "eranin", "-to", "dahan", "-jr", "6"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "======== Eranin to Dahan, 2 jumps") {
+		t.Errorf("got:\n%v", buf.String())
+	}
+}
+
+func TestBestCommand(t *testing.T) {
+	archive := filepath.Join("data", "input.json")
+	var buf bytes.Buffer
+	args := []string{"-archive", archive, "-json", "-station", "azeban", "-ship", "hauler", "-jr", "20", "-n", "3"}
+	if err := bestCommand(args, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Stations []struct {
+			Station string
+			Routes  []struct {
+				Units     int
+				JumpRange float64
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatalf("%v in:\n%v", err, buf.String())
+	}
+	if len(res.Stations) != 1 || res.Stations[0].Station != "Eranin (AZEBAN CITY)" || len(res.Stations[0].Routes) != 3 {
+		t.Fatalf("got %+v, want 3 routes from Eranin (AZEBAN CITY)", res)
+	}
+	for _, r := range res.Stations[0].Routes {
+		// The hauler's cargo, but the -jr flag.
+		if r.Units > ships["hauler"].Cargo || r.JumpRange != 20 {
+			t.Errorf("got %+v, want at most %d units and a range of 20", r, ships["hauler"].Cargo)
+		}
+	}
+
+	if err := bestCommand([]string{"-archive", archive, "-ship", "zeppelin"}, &buf); err == nil {
+		t.Error("no error for an unknown ship")
+	}
+	if err := bestCommand([]string{"-archive", archive, "-station", "nowhere"}, &buf); err == nil || !strings.Contains(err.Error(), "nowhere") {
+		t.Errorf("got error %v, want an unknown station", err)
+	}
+}
+
+func TestPricesCommand(t *testing.T) {
+	var buf bytes.Buffer
+	if err := pricesCommand([]string{"-archive", filepath.Join("data", "input.json"), "-item", "gold"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "gold:\n") || !strings.Contains(buf.String(), "sell gold at ") {
+		t.Errorf("got:\n%v", buf.String())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+var confidenceHalfLife = flag.Duration("confidenceHalfLife", time.Hour, "age at which a quote counts for half in route confidence scores")
+
+// maxStationSenders bounds the senders remembered for each station.
+const maxStationSenders = 32
+
+// activity records who updates a station's market and how often.
+type activity struct {
+	// Senders maps the recent senders to the time of their newest quote.
+	// Senders older than -confidenceHalfLife before the station's newest
+	// quote are forgotten.
+	Senders map[string]time.Time
+	Updates int
+	// First and Last are the timestamps of the oldest and newest quotes
+	// received.
+	First, Last time.Time
+}
+
+func (s marketStore) recordActivity(t emdn.Transaction) {
+	a, ok := s.stationActivity[t.Station]
+	if !ok {
+		a = &activity{Senders: make(map[string]time.Time)}
+		s.stationActivity[t.Station] = a
+	}
+	a.Updates++
+	if !t.Timestamp.IsZero() {
+		if a.First.IsZero() || t.Timestamp.Before(a.First) {
+			a.First = t.Timestamp
+		}
+		if t.Timestamp.After(a.Last) {
+			a.Last = t.Timestamp
+		}
+	}
+	if t.Sender != "" {
+		a.addSender(t.Sender, t.Timestamp)
+	}
+}
+
+// addSender records a quote from sender, and forgets the senders that
+// haven't been heard from recently, or the oldest ones if there are too many.
+func (a *activity) addSender(sender string, at time.Time) {
+	if last, ok := a.Senders[sender]; !ok || at.After(last) {
+		a.Senders[sender] = at
+	}
+	oldest := ""
+	for sender, last := range a.Senders {
+		if a.Last.Sub(last) > *confidenceHalfLife {
+			delete(a.Senders, sender)
+			continue
+		}
+		if oldest == "" || last.Before(a.Senders[oldest]) {
+			oldest = sender
+		}
+	}
+	if len(a.Senders) > maxStationSenders {
+		delete(a.Senders, oldest)
+	}
+}
+
+// marketTime is the timestamp of the newest quote received. Ages are measured
+// from it rather than from the clock, so that a replayed cache looks as it
+// did live.
+func (s marketStore) marketTime() (now time.Time) {
+	for _, a := range s.stationActivity {
+		if a.Last.After(now) {
+			now = a.Last
+		}
+	}
+	return now
+}
+
+// quoteConfidence scores a quote from 0 to 1. Fresh quotes score higher, as
+// do quotes from stations recently updated by several senders, which
+// corroborate each other.
+func (s marketStore) quoteConfidence(t emdn.Transaction, now time.Time) float64 {
+	freshness := 1.0
+	if !t.Timestamp.IsZero() && *confidenceHalfLife > 0 {
+		if age := now.Sub(t.Timestamp); age > 0 {
+			freshness = math.Pow(0.5, float64(age)/float64(*confidenceHalfLife))
+		}
+	}
+	senders := 1
+	if a, ok := s.stationActivity[t.Station]; ok && len(a.Senders) > 1 {
+		senders = len(a.Senders)
+	}
+	return freshness * (1 - math.Pow(0.5, float64(senders)))
+}
+
+// routeConfidence scores the prices a route relies on: the source's price,
+// unless the cargo is already in the hold, and the destination's.
+func (s marketStore) routeConfidence(item, source, destination string, now time.Time) float64 {
+	c := s.quoteConfidence(s.stationDemand[destination][item], now)
+	if source != "" {
+		if t, ok := s.stationSupply[source][item]; ok {
+			c *= s.quoteConfidence(t, now)
+		}
+	}
+	return c
+}
+
+// StationCoverage describes how well a station's market is known.
+type StationCoverage struct {
+	Station string `json:"station"`
+	Items   int    `json:"items"`
+	// Newest and Oldest are the timestamps of the station's newest and
+	// oldest current quotes, and their ages are measured from the market
+	// time.
+	Newest           time.Time `json:"newest"`
+	Oldest           time.Time `json:"oldest"`
+	NewestAgeSeconds float64   `json:"newestAgeSeconds"`
+	OldestAgeSeconds float64   `json:"oldestAgeSeconds"`
+	Senders          int       `json:"senders"`
+	Updates          int       `json:"updates"`
+	// UpdatesPerHour is measured between the first and last quotes
+	// received. It's zero if they all arrived at once.
+	UpdatesPerHour float64 `json:"updatesPerHour"`
+}
+
+// coverage describes every station's market, best covered first.
+func (s marketStore) coverage() []StationCoverage {
+	now := s.marketTime()
+	var list []StationCoverage
+	for station, a := range s.stationActivity {
+		c := StationCoverage{Station: station, Senders: len(a.Senders), Updates: a.Updates}
+		items := make(map[string]bool)
+		for _, m := range []map[string]map[string]emdn.Transaction{s.stationSupply, s.stationDemand} {
+			for item, t := range m[station] {
+				items[item] = true
+				if t.Timestamp.IsZero() {
+					continue
+				}
+				if t.Timestamp.After(c.Newest) {
+					c.Newest = t.Timestamp
+				}
+				if c.Oldest.IsZero() || t.Timestamp.Before(c.Oldest) {
+					c.Oldest = t.Timestamp
+				}
+			}
+		}
+		c.Items = len(items)
+		if !c.Newest.IsZero() {
+			c.NewestAgeSeconds = now.Sub(c.Newest).Seconds()
+			c.OldestAgeSeconds = now.Sub(c.Oldest).Seconds()
+		}
+		if span := a.Last.Sub(a.First); span > 0 {
+			c.UpdatesPerHour = float64(a.Updates) / span.Hours()
+		}
+		list = append(list, c)
+	}
+	sort.Sort(coverageByItems(list))
+	return list
+}
+
+type coverageByItems []StationCoverage
+
+func (c coverageByItems) Len() int      { return len(c) }
+func (c coverageByItems) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c coverageByItems) Less(i, j int) bool {
+	if c[i].Items != c[j].Items {
+		return c[i].Items > c[j].Items
+	}
+	if !c[i].Newest.Equal(c[j].Newest) {
+		return c[i].Newest.After(c[j].Newest)
+	}
+	return c[i].Station < c[j].Station
+}
+
+// coverageResult is the result of a /coverage query.
+type coverageResult struct {
+	MarketTime time.Time         `json:"marketTime"`
+	Stations   []StationCoverage `json:"stations"`
+}
+
+func (s marketStore) queryCoverage(r *http.Request) (res coverageResult, err error) {
+	res.MarketTime = s.marketTime()
+	res.Stations = append([]StationCoverage{}, s.coverage()...)
+	if n, _ := strconv.Atoi(r.FormValue("n")); n > 0 && len(res.Stations) > n {
+		res.Stations = res.Stations[:n]
+	}
+	return res, nil
+}
+
+// ageText formats an age in seconds for the text views.
+func ageText(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// coverageHandler lists how well each station's market is known.
+func (s marketStore) coverageHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, _ := s.queryCoverage(r)
+	fmt.Fprintf(w, "======== market time %v =======\n", res.MarketTime.Format(time.RFC1123))
+	for _, c := range res.Stations {
+		fmt.Fprintf(w, "%v: %d items, newest quote %v old, oldest %v old, %d senders, %d updates, %.1f updates/hour\n",
+			c.Station, c.Items, ageText(c.NewestAgeSeconds), ageText(c.OldestAgeSeconds), c.Senders, c.Updates, c.UpdatesPerHour)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestQuoteConfidence(t *testing.T) {
+	store := newMarketStore()
+	now := time.Date(2014, 8, 22, 12, 0, 0, 0, time.UTC)
+	fresh := emdn.Transaction{Station: "A (A)", Item: "gold", Sender: "x", Timestamp: now}
+	store.record(fresh)
+	if c := store.quoteConfidence(fresh, now); c != 0.5 {
+		t.Errorf("fresh quote from one sender: got %v, want 0.5", c)
+	}
+	old := fresh
+	old.Timestamp = now.Add(-*confidenceHalfLife)
+	if c := store.quoteConfidence(old, now); math.Abs(c-0.25) > 1e-9 {
+		t.Errorf("quote one half-life old: got %v, want 0.25", c)
+	}
+	corroborated := fresh
+	corroborated.Sender = "y"
+	store.record(corroborated)
+	if c := store.quoteConfidence(fresh, now); c != 0.75 {
+		t.Errorf("fresh quote from a station with two senders: got %v, want 0.75", c)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	store := testStore(t)
+	start := store.marketTime()
+	for i, sender := range []string{"x", "y", "x"} {
+		store.record(emdn.Transaction{Station: "New (STATION)", Item: "gold", Sender: sender, Timestamp: start.Add(time.Duration(i) * 30 * time.Minute)})
+	}
+	list := store.coverage()
+	if len(list) < 2 {
+		t.Fatalf("got %d stations", len(list))
+	}
+	for i, c := range list {
+		if i > 0 && c.Items > list[i-1].Items {
+			t.Errorf("stations out of order at %v", c.Station)
+		}
+		if c.NewestAgeSeconds > c.OldestAgeSeconds {
+			t.Errorf("%v: newest quote older than the oldest", c.Station)
+		}
+		if c.Station == "New (STATION)" {
+			if c.Items != 1 || c.Senders != 2 || c.Updates != 3 || c.UpdatesPerHour != 3 || c.NewestAgeSeconds != 0 {
+				t.Errorf("got %+v", c)
+			}
+		} else if c.Senders != 1 {
+			t.Errorf("%v: got %d senders, wanted the test data's only sender", c.Station, c.Senders)
+		}
+	}
+}
+
+func TestRecentSenders(t *testing.T) {
+	store := newMarketStore()
+	start := time.Date(2014, 8, 22, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*maxStationSenders; i++ {
+		store.record(emdn.Transaction{Station: "A (A)", Item: "gold", Sender: fmt.Sprint("sender", i), Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	a := store.stationActivity["A (A)"]
+	if len(a.Senders) != maxStationSenders {
+		t.Errorf("remembered %d senders, want at most %d", len(a.Senders), maxStationSenders)
+	}
+	// Later, a single sender is left.
+	later := start.Add(2 * *confidenceHalfLife)
+	store.record(emdn.Transaction{Station: "A (A)", Item: "gold", Sender: "x", Timestamp: later})
+	if len(a.Senders) != 1 {
+		t.Errorf("remembered %d senders, want only the recent one", len(a.Senders))
+	}
+	if c := store.quoteConfidence(emdn.Transaction{Station: "A (A)", Timestamp: later}, later); c != 0.5 {
+		t.Errorf("confidence %v, want 0.5 for a single recent sender", c)
+	}
+}
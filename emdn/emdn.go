@@ -14,6 +14,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	zmq "github.com/pebbe/zmq2"
 
 	"flag"
@@ -25,16 +29,21 @@ var showLog = flag.Bool("showLog", false, "Show EMDN messages on the stdout, use
 type Message struct {
 	Transaction Transaction `json:"message"`
 	Type        string      `json:"type"`
+	// Sender identifies the client that uploaded the message.
+	Sender string `json:"sender"`
 }
 
 type Transaction struct {
-	BuyPrice  float64 `json:"buyPrice"`
-	Category  string  `json:"categoryName"`
-	Demand    int     `json:"demand"`
-	Supply    int     `json:"stationStock"`
-	Item      string  `json:"itemName"`
-	SellPrice float64 `json:"sellPrice"`
-	Station   string  `json:"stationName"`
+	BuyPrice  float64   `json:"buyPrice"`
+	Category  string    `json:"categoryName"`
+	Demand    int       `json:"demand"`
+	Supply    int       `json:"stationStock"`
+	Item      string    `json:"itemName"`
+	SellPrice float64   `json:"sellPrice"`
+	Station   string    `json:"stationName"`
+	Timestamp time.Time `json:"timestamp"`
+	// Sender is copied from the Message.
+	Sender string `json:"-"`
 }
 
 /*
@@ -58,6 +67,35 @@ func CacheRead() <-chan Message {
 	return fileRead(f)
 }
 
+// gzipFile closes both the decompressor and the file under it.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// ArchiveRead replays the messages saved in a file, one JSON message after
+// the other as written by -showLog. Files ending in ".gz" are decompressed.
+func ArchiveRead(path string) (<-chan Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return fileRead(f), nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return fileRead(gzipFile{gz, f}), nil
+}
+
 func TestSubscribe() (<-chan Message, error) {
 	f, err := os.Open(filepath.Join("data", "input.json"))
 	if err != nil {
@@ -76,33 +114,118 @@ func fileRead(f io.ReadCloser) <-chan Message {
 			var m Message
 			if err := dec.Decode(&m); err != nil {
 				if err != io.EOF {
+					atomic.AddInt64(&Stats.Received, 1)
+					atomic.AddInt64(&Stats.Rejected, 1)
 					log.Print("fileRead:", err)
 				}
 				break
 			}
+			atomic.AddInt64(&Stats.Received, 1)
+			atomic.AddInt64(&Stats.Decoded, 1)
+			m.Transaction.Sender = m.Sender
 			c <- m
-			fmt.Print("-")
 		}
-		fmt.Println("finished processing local file")
 	}()
 	return c
 }
 
+// Counters describe the health of the feed. Read them with Snapshot.
+type Counters struct {
+	// Received counts the raw messages, Decoded those that could be read and
+	// Rejected those that couldn't.
+	Received int64
+	Decoded  int64
+	Rejected int64
+	// Deduped counts the messages dropped because they were already
+	// delivered by the relay.
+	Deduped int64
+}
+
+// Stats counts the messages of Subscribe and of the file readers.
+var Stats Counters
+
+// Snapshot reads the counters atomically.
+func (c *Counters) Snapshot() Counters {
+	return Counters{
+		Received: atomic.LoadInt64(&c.Received),
+		Decoded:  atomic.LoadInt64(&c.Decoded),
+		Rejected: atomic.LoadInt64(&c.Rejected),
+		Deduped:  atomic.LoadInt64(&c.Deduped),
+	}
+}
+
+// dedupWindow is the number of recent messages remembered to spot duplicates.
+const dedupWindow = 1024
+
+// deduper remembers the last messages, since the relay may deliver a message
+// more than once.
+type deduper struct {
+	seen map[Message]bool
+	ring []Message
+	next int
+}
+
+func newDeduper(n int) *deduper {
+	return &deduper{seen: make(map[Message]bool), ring: make([]Message, 0, n)}
+}
+
+// add reports whether m was seen recently, and remembers it otherwise.
+func (d *deduper) add(m Message) bool {
+	m.Transaction.Timestamp = m.Transaction.Timestamp.UTC()
+	if d.seen[m] {
+		return true
+	}
+	if len(d.ring) < cap(d.ring) {
+		d.ring = append(d.ring, m)
+	} else {
+		delete(d.seen, d.ring[d.next])
+		d.ring[d.next] = m
+		d.next = (d.next + 1) % len(d.ring)
+	}
+	d.seen[m] = true
+	return false
+}
+
+// decode reads a compressed message from the relay.
+func decode(buf []byte) (m Message, err error) {
+	r, err := zlib.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	var tee io.Reader = r
+	if *showLog {
+		tee = io.TeeReader(r, os.Stdout)
+	}
+	if err = json.NewDecoder(tee).Decode(&m); err != nil {
+		return m, err
+	}
+	m.Transaction.Sender = m.Sender
+	return m, nil
+}
+
+// Subscribe receives the messages of the relay. The channel is closed if the
+// connection fails, and the caller should subscribe again.
 func Subscribe() (<-chan Message, error) {
 	receiver, err := zmq.NewSocket(zmq.SUB)
 	if err != nil {
 		return nil, fmt.Errorf("zmq.NewSocket: %v", err)
 	}
 	if err = receiver.Connect("tcp://firehose.elite-market-data.net:9500"); err != nil {
+		receiver.Close()
 		return nil, fmt.Errorf("receiver.Connect: %v", err)
 	}
 	if err := receiver.SetSubscribe(""); err != nil {
+		receiver.Close()
 		return nil, fmt.Errorf("receiver.SetSubscribe: %v", err)
 	}
 	c := make(chan Message)
 
 	go func() {
-		for { // Start over if we have trouble.
+		defer close(c)
+		defer receiver.Close()
+		seen := newDeduper(dedupWindow)
+		for {
 			// TODO: Find a way to avoid all the extra allocations.
 			msgs, err := receiver.RecvMessageBytes(0)
 			if err != nil {
@@ -110,26 +233,19 @@ func Subscribe() (<-chan Message, error) {
 				return
 			}
 			for _, buf := range msgs {
-				r, err := zlib.NewReader(bytes.NewReader(buf))
+				atomic.AddInt64(&Stats.Received, 1)
+				m, err := decode(buf)
 				if err != nil {
-					log.Print(err)
-					return
-				}
-				var tee io.Reader = r
-				if *showLog {
-					tee = io.TeeReader(r, os.Stdout)
+					atomic.AddInt64(&Stats.Rejected, 1)
+					log.Print("Subscribe: ", err)
+					continue
 				}
-				dec := json.NewDecoder(tee)
-				var m Message
-				if err = dec.Decode(&m); err != nil {
-					if err != io.EOF {
-						log.Print("Subscribe:", err)
-						break
-					}
+				atomic.AddInt64(&Stats.Decoded, 1)
+				if seen.add(m) {
+					atomic.AddInt64(&Stats.Deduped, 1)
+					continue
 				}
 				c <- m
-				fmt.Print(".")
-				r.Close()
 			}
 		}
 	}()
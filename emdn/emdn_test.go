@@ -0,0 +1,29 @@
+package emdn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduper(t *testing.T) {
+	d := newDeduper(2)
+	at := time.Date(2014, 8, 22, 19, 21, 38, 0, time.UTC)
+	a := Message{Transaction: Transaction{Station: "A", Item: "gold", SellPrice: 100, Timestamp: at}}
+	b, c := a, a
+	b.Transaction.SellPrice = 101
+	c.Transaction.Station = "C"
+	if d.add(a) || d.add(b) {
+		t.Fatal("new messages reported as duplicates")
+	}
+	// The same time in another zone is the same message.
+	dup := a
+	dup.Transaction.Timestamp = at.In(time.FixedZone("CEST", 2*3600))
+	if !d.add(dup) {
+		t.Error("duplicate not spotted")
+	}
+	// Pushes a out of the window.
+	d.add(c)
+	if d.add(a) {
+		t.Error("message outside the window reported as a duplicate")
+	}
+}
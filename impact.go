@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+var defaultElasticity = flag.Float64("defaultElasticity", 0.1, "market impact assumed for items without enough price history: the relative price change per relative change of demand or supply")
+
+// minImpactObservations is the number of price changes needed before an
+// item's fitted elasticity replaces the default.
+const minImpactObservations = 5
+
+// maxRepeatRuns caps the repeat run estimates.
+const maxRepeatRuns = 100
+
+// impactFit accumulates the observed (relative quantity change, relative
+// price change) pairs of an item for a least squares fit through the origin.
+// Only the sums are kept, so the fit is updated in constant time and memory.
+type impactFit struct {
+	N        int
+	Sxx, Sxy float64
+}
+
+func (f *impactFit) add(x, y float64) {
+	// Large jumps are restocks or new stations, not the effect of trading.
+	if x == 0 || math.Abs(x) > 1 {
+		return
+	}
+	f.N++
+	f.Sxx += x * x
+	f.Sxy += x * y
+}
+
+// elasticity is the relative price change for a relative change of the
+// quantity, e.g. 0.1 if selling 10% of a station's demand lowers its price
+// by 1%. It's kept between 0 and 1.
+func (f impactFit) elasticity() float64 {
+	if f.N < minImpactObservations || f.Sxx == 0 {
+		return *defaultElasticity
+	}
+	return math.Max(0, math.Min(1, f.Sxy/f.Sxx))
+}
+
+// itemImpact holds the fits of an item's sell prices against demand and of
+// its buy prices against supply.
+type itemImpact struct {
+	Demand impactFit
+	Supply impactFit
+}
+
+// recordImpact compares a quote with the station's previous one for the
+// item. It must be called before the quote is stored.
+func (s marketStore) recordImpact(t emdn.Transaction) {
+	m, ok := s.itemImpact[t.Item]
+	if !ok {
+		m = &itemImpact{}
+		s.itemImpact[t.Item] = m
+	}
+	if prev, ok := s.stationDemand[t.Station][t.Item]; ok && sellQuote(prev) && sellQuote(t) {
+		m.Demand.add(float64(t.Demand-prev.Demand)/float64(prev.Demand), (t.SellPrice-prev.SellPrice)/prev.SellPrice)
+	}
+	// Prices rise as supply runs out, so the supply change is negated to
+	// keep the elasticity positive.
+	if prev, ok := s.stationSupply[t.Station][t.Item]; ok && buyQuote(prev) && buyQuote(t) {
+		m.Supply.add(-float64(t.Supply-prev.Supply)/float64(prev.Supply), (t.BuyPrice-prev.BuyPrice)/prev.BuyPrice)
+	}
+}
+
+// elasticities returns the fitted market impact of an item when selling and
+// when buying.
+func (s marketStore) elasticities(item string) (sell, buy float64) {
+	if m, ok := s.itemImpact[item]; ok {
+		return m.Demand.elasticity(), m.Supply.elasticity()
+	}
+	return *defaultElasticity, *defaultElasticity
+}
+
+// trade predicts the prices of successive units of an item carried between
+// two quotes. The n-th unit sold gets SellPrice*(1 - SellElasticity*n/Demand)
+// and the n-th unit bought costs BuyPrice*(1 + BuyElasticity*n/Supply).
+type trade struct {
+	BuyPrice       float64
+	Supply         int
+	BuyElasticity  float64
+	SellPrice      float64
+	Demand         int
+	SellElasticity float64
+}
+
+func (s marketStore) newTrade(item string, supply, demand emdn.Transaction) trade {
+	sell, buy := s.elasticities(item)
+	return trade{
+		BuyPrice:       supply.BuyPrice,
+		Supply:         supply.Supply,
+		BuyElasticity:  buy,
+		SellPrice:      demand.SellPrice,
+		Demand:         demand.Demand,
+		SellElasticity: sell,
+	}
+}
+
+// sumRange is from + (from+1) + ... + (to-1).
+func sumRange(from, to int) float64 {
+	if to <= from {
+		return 0
+	}
+	return float64(from+to-1) * float64(to-from) / 2
+}
+
+// revenue is the income from selling units from to from+n-1 of the demand.
+// Prices don't go below zero.
+func (t trade) revenue(from, n int) float64 {
+	if t.SellElasticity == 0 || t.Demand == 0 {
+		return t.SellPrice * float64(n)
+	}
+	to := from + n
+	if zero := int(math.Ceil(float64(t.Demand) / t.SellElasticity)); to > zero {
+		to = zero
+	}
+	if to <= from {
+		return 0
+	}
+	return t.SellPrice * (float64(to-from) - t.SellElasticity/float64(t.Demand)*sumRange(from, to))
+}
+
+// cost is the price of buying units from to from+n-1 of the supply.
+func (t trade) cost(from, n int) float64 {
+	if t.BuyElasticity == 0 || t.Supply == 0 {
+		return t.BuyPrice * float64(n)
+	}
+	return t.BuyPrice * (float64(n) + t.BuyElasticity/float64(t.Supply)*sumRange(from, from+n))
+}
+
+func (t trade) profit(from, n int) float64 {
+	return t.revenue(from, n) - t.cost(from, n)
+}
+
+// profitableUnits caps n to the units that each still make a profit, since the
+// margin shrinks with every unit.
+func (t trade) profitableUnits(n int) int {
+	// The margin of unit j is positive while j < margin/decline.
+	margin := t.SellPrice - t.BuyPrice
+	var decline float64
+	if t.Demand > 0 {
+		decline += t.SellPrice * t.SellElasticity / float64(t.Demand)
+	}
+	if t.Supply > 0 {
+		decline += t.BuyPrice * t.BuyElasticity / float64(t.Supply)
+	}
+	if margin <= 0 {
+		return 0
+	}
+	if decline == 0 {
+		return n
+	}
+	if max := math.Ceil(margin / decline); max < float64(n) {
+		return int(max)
+	}
+	return n
+}
+
+// runs estimates how many times a trade of n units can be repeated before it
+// stops paying, assuming the market doesn't recover in between.
+func (t trade) runs(n int) int {
+	runs := 0
+	for from := 0; n > 0 && runs < maxRepeatRuns; from += n {
+		k := n
+		if t.Demand > 0 && from+k > t.Demand {
+			k = t.Demand - from
+		}
+		if t.Supply > 0 && from+k > t.Supply {
+			k = t.Supply - from
+		}
+		if k <= 0 || t.profit(from, k) <= 0 {
+			break
+		}
+		runs++
+	}
+	return runs
+}
+
+// ItemImpact is the fitted market impact of an item.
+type ItemImpact struct {
+	Item string `json:"item"`
+	// SellElasticity applies to sell prices as demand is consumed and
+	// BuyElasticity to buy prices as supply is.
+	SellElasticity   float64 `json:"sellElasticity"`
+	SellObservations int     `json:"sellObservations"`
+	BuyElasticity    float64 `json:"buyElasticity"`
+	BuyObservations  int     `json:"buyObservations"`
+}
+
+// impactResult is the result of an /impact query.
+type impactResult struct {
+	Items []ItemImpact `json:"items"`
+}
+
+func (s marketStore) queryImpact(r *http.Request) (res impactResult, err error) {
+	var item string
+	if name := r.FormValue("item"); name != "" {
+		if item, err = s.resolveItem(name); err != nil {
+			return res, err
+		}
+	}
+	res.Items = []ItemImpact{}
+	for i, m := range s.itemImpact {
+		if item != "" && i != item {
+			continue
+		}
+		res.Items = append(res.Items, ItemImpact{
+			Item:             i,
+			SellElasticity:   m.Demand.elasticity(),
+			SellObservations: m.Demand.N,
+			BuyElasticity:    m.Supply.elasticity(),
+			BuyObservations:  m.Supply.N,
+		})
+	}
+	sort.Sort(impactByItem(res.Items))
+	return res, nil
+}
+
+type impactByItem []ItemImpact
+
+func (m impactByItem) Len() int           { return len(m) }
+func (m impactByItem) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m impactByItem) Less(i, j int) bool { return m[i].Item < m[j].Item }
+
+// impactHandler shows the market impact model of each item.
+func (s marketStore) impactHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryImpact(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	for _, m := range res.Items {
+		fmt.Fprintf(w, "%v: sell elasticity %.3f (%d observations), buy elasticity %.3f (%d observations)\n", m.Item, m.SellElasticity, m.SellObservations, m.BuyElasticity, m.BuyObservations)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestImpactFit(t *testing.T) {
+	var f impactFit
+	if e := f.elasticity(); e != *defaultElasticity {
+		t.Errorf("no observations: got %v, want the default %v", e, *defaultElasticity)
+	}
+	for _, x := range []float64{-0.1, -0.2, 0.1, -0.05, 0.3} {
+		f.add(x, 0.2*x)
+	}
+	// Ignored: no change, and a restock.
+	f.add(0, 0.1)
+	f.add(5, 0)
+	if f.N != 5 || math.Abs(f.elasticity()-0.2) > 1e-9 {
+		t.Errorf("got %+v, elasticity %v; want 5 observations and 0.2", f, f.elasticity())
+	}
+}
+
+func TestRecordImpact(t *testing.T) {
+	store := newMarketStore()
+	price, demand := 1000.0, 1000
+	for i := 0; i < minImpactObservations; i++ {
+		store.record(emdn.Transaction{Station: "A (A)", Item: "gold", SellPrice: price, Demand: demand})
+		// Selling 10% of the demand lowers the price by 3%.
+		price *= 0.97
+		demand = demand * 9 / 10
+	}
+	store.record(emdn.Transaction{Station: "A (A)", Item: "gold", SellPrice: price, Demand: demand})
+	if sell, _ := store.elasticities("gold"); math.Abs(sell-0.3) > 0.01 {
+		t.Errorf("sell elasticity %v, want about 0.3", sell)
+	}
+}
+
+func TestTrade(t *testing.T) {
+	tr := trade{BuyPrice: 100, Supply: 100, BuyElasticity: 0.5, SellPrice: 200, Demand: 100, SellElasticity: 0.5}
+	// Unit by unit.
+	var revenue, cost float64
+	for j := 0; j < 10; j++ {
+		revenue += 200 * (1 - 0.5*float64(j)/100)
+		cost += 100 * (1 + 0.5*float64(j)/100)
+	}
+	if got := tr.revenue(0, 10); math.Abs(got-revenue) > 1e-9 {
+		t.Errorf("revenue = %v; want %v", got, revenue)
+	}
+	if got := tr.cost(0, 10); math.Abs(got-cost) > 1e-9 {
+		t.Errorf("cost = %v; want %v", got, cost)
+	}
+	// Unit j has a margin of 100 - 1.5j, positive up to j = 66.
+	if n := tr.profitableUnits(1000); n != 67 {
+		t.Errorf("profitableUnits = %d; want 67", n)
+	}
+	if n := tr.profitableUnits(10); n != 10 {
+		t.Errorf("profitableUnits(10) = %d; want 10", n)
+	}
+	// 20 units per run: the runs starting at units 0, 20 and 40 pay, the
+	// one starting at 60 doesn't.
+	if runs := tr.runs(20); runs != 3 {
+		t.Errorf("runs(20) = %d; want 3", runs)
+	}
+	// Prices don't go negative.
+	steep := trade{SellPrice: 100, Demand: 10, SellElasticity: 1}
+	if got := steep.revenue(0, 50); got != steep.revenue(0, 10) {
+		t.Errorf("revenue past zero price = %v; want %v", got, steep.revenue(0, 10))
+	}
+	flat := trade{BuyPrice: 10, SellPrice: 20}
+	if got := flat.profit(0, 5); got != 50 {
+		t.Errorf("profit without impact = %v; want 50", got)
+	}
+}
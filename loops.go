@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The search for loops is exponential in the number of stations, and runs
+// with the store locked, so the /loops parameters are bounded.
+const (
+	maxLoopStations = 5
+	maxLoopJumps    = 50
+	// maxTradeGraphs bounds the graphs cached for different queries.
+	maxTradeGraphs = 16
+)
+
+// Loop is a closed trade circuit. Each leg starts where the previous one
+// ended and the last leg returns to the first station.
+type Loop struct {
+	Legs        []Route `json:"legs"`
+	Jumps       int     `json:"jumps"`
+	TotalProfit float64 `json:"totalProfit"`
+}
+
+// tradeGraph holds the most profitable cargo for each pair of stations.
+// source station => destination station => route
+type tradeGraph map[string]map[string]Route
+
+// tradeGraph builds the graph of profitable legs between all known stations
+// allowed by the query's filter. Destinations that are out of reach with the
+// query's jump range are left out.
+func (s marketStore) tradeGraph(q routeQuery) tradeGraph {
+	g := make(tradeGraph)
+	jc := newJumpCache(q.JumpRange, q.Constraints)
+	for source := range s.stationSupply {
+		if !q.Filter.allows(source) {
+			continue
+		}
+		q.Station = source
+		for _, route := range s.candidateRoutes(q, jc) {
+			destination := route.DestinationStation
+			if best, ok := g[source][destination]; ok && best.TotalProfit >= route.TotalProfit {
+				continue
+			}
+			if g[source] == nil {
+				g[source] = make(map[string]Route)
+			}
+			g[source][destination] = route
+		}
+	}
+	return g
+}
+
+// cachedGraph is a trade graph and the version of the station registry it
+// was built with.
+type cachedGraph struct {
+	g        tradeGraph
+	stations int
+}
+
+// cachedTradeGraph returns the trade graph of the query, reusing the one
+// built by an earlier request if no quote was recorded and no station
+// metadata changed since. Building a graph looks for routes between every
+// pair of stations, which is too slow to repeat for each /loops request. The
+// caller must hold the lock.
+func (s marketStore) cachedTradeGraph(q routeQuery) tradeGraph {
+	key := fmt.Sprintf("%v|%v|%v|%+v|%+v|%v|%v", q.CreditLimit, q.JumpRange, q.Cargo, q.Filter, q.Constraints, q.Categories, q.Exclude)
+	version := stationInfo.version()
+	if c, ok := s.tradeGraphs[key]; ok && c.stations == version {
+		return c.g
+	}
+	for k, c := range s.tradeGraphs {
+		if c.stations != version || len(s.tradeGraphs) >= maxTradeGraphs {
+			delete(s.tradeGraphs, k)
+		}
+	}
+	g := s.tradeGraph(q)
+	s.tradeGraphs[key] = cachedGraph{g, version}
+	return g
+}
+
+// bestLoops finds the most profitable closed circuits visiting between 2 and
+// maxStations stations. Every leg carries the best cargo for that leg. If
+// maxJumps is positive, loops needing more hyperspace jumps are discarded. If
+// the query's station is empty, loops starting anywhere are considered. At
+// most q.Limit loops are returned, sorted by decreasing profit.
+func (s marketStore) bestLoops(q routeQuery, maxStations int, maxJumps int) []Loop {
+	station, limit := q.Station, q.Limit
+	g := s.cachedTradeGraph(q)
+	starts := make([]string, 0, len(g))
+	if station != "" {
+		starts = append(starts, station)
+	} else {
+		for source := range g {
+			starts = append(starts, source)
+		}
+	}
+	var loops []Loop
+	for _, start := range starts {
+		visited := map[string]bool{start: true}
+		var walk func(at string, legs []Route, jumps int, profit float64)
+		walk = func(at string, legs []Route, jumps int, profit float64) {
+			for next, leg := range g[at] {
+				j := jumps + leg.JumpCount()
+				if maxJumps > 0 && j > maxJumps {
+					continue
+				}
+				if next == start {
+					if len(legs) > 0 {
+						loop := Loop{Jumps: j, TotalProfit: profit + leg.TotalProfit}
+						loop.Legs = append(append(loop.Legs, legs...), leg)
+						loops = append(loops, loop)
+					}
+					continue
+				}
+				// When looking everywhere, only report each circuit
+				// once, from its first station in alphabetical order.
+				if visited[next] || len(legs)+1 >= maxStations || (station == "" && next < start) {
+					continue
+				}
+				visited[next] = true
+				walk(next, append(legs, leg), j, profit+leg.TotalProfit)
+				visited[next] = false
+			}
+		}
+		walk(start, nil, 0, 0)
+	}
+	sort.Sort(loopsByProfit(loops))
+	if limit > 0 && len(loops) > limit {
+		loops = loops[:limit]
+	}
+	return loops
+}
+
+type loopsByProfit []Loop
+
+func (l loopsByProfit) Len() int      { return len(l) }
+func (l loopsByProfit) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l loopsByProfit) Less(i, j int) bool {
+	if l[i].TotalProfit != l[j].TotalProfit {
+		return l[i].TotalProfit > l[j].TotalProfit
+	}
+	// Fewer jumps first, then by name so the output is stable.
+	if l[i].Jumps != l[j].Jumps {
+		return l[i].Jumps < l[j].Jumps
+	}
+	return l[i].Legs[0].SourceStation < l[j].Legs[0].SourceStation
+}
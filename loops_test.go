@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestBestLoops(t *testing.T) {
+	store := testStore(t)
+	loops := store.bestLoops(routeQuery{CreditLimit: 2000000, JumpRange: 100, Cargo: 10}, 3, 0)
+	if len(loops) == 0 {
+		t.Fatalf("no loops found")
+	}
+	for i, loop := range loops {
+		if n := len(loop.Legs); n < 2 || n > 3 {
+			t.Errorf("loop %d has %d legs, wanted 2 or 3", i, n)
+		}
+		var profit float64
+		for j, leg := range loop.Legs {
+			next := loop.Legs[(j+1)%len(loop.Legs)]
+			if leg.DestinationStation != next.SourceStation {
+				t.Errorf("loop %d is not closed: leg %d ends at %v, next starts at %v", i, j, leg.DestinationStation, next.SourceStation)
+			}
+			if leg.TotalProfit <= 0 {
+				t.Errorf("loop %d leg %d carries no profit: %+v", i, j, leg)
+			}
+			profit += leg.TotalProfit
+		}
+		if profit != loop.TotalProfit {
+			t.Errorf("loop %d profit %v, wanted the sum of its legs %v", i, loop.TotalProfit, profit)
+		}
+		if i > 0 && loop.TotalProfit > loops[i-1].TotalProfit {
+			t.Errorf("loops not sorted by profit at %d", i)
+		}
+	}
+
+	// A starting station and a jump budget restrict the search.
+	station := "Asellus Primus (BEAGLE 2 LANDING)"
+	for _, loop := range store.bestLoops(routeQuery{Station: station, CreditLimit: 2000000, JumpRange: 100, Cargo: 10}, 4, 3) {
+		if loop.Legs[0].SourceStation != station {
+			t.Errorf("loop starts at %v, wanted %v", loop.Legs[0].SourceStation, station)
+		}
+		if loop.Jumps > 3 {
+			t.Errorf("loop has %d jumps, wanted at most 3", loop.Jumps)
+		}
+	}
+}
+
+func TestLoopsLimits(t *testing.T) {
+	store := testStore(t)
+	for _, query := range []string{"stations=6", "stations=50", "maxjumps=51", "maxjumps=-1"} {
+		r, _ := http.NewRequest("GET", "/loops?"+query, nil)
+		if _, err := store.queryLoops(r); err == nil || errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("%v: got error %v, want a bad request", query, err)
+		}
+	}
+	r, _ := http.NewRequest("GET", "/loops?stations=2&n=1&jr=100", nil)
+	res, err := store.queryLoops(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Loops) != 1 || len(res.Loops[0].Legs) != 2 {
+		t.Errorf("stations=2&n=1: got %+v, want one loop of 2 stations", res.Loops)
+	}
+	if len(store.tradeGraphs) != 1 {
+		t.Errorf("got %d cached trade graphs, want 1", len(store.tradeGraphs))
+	}
+	store.record(emdn.Transaction{Station: "Eranin (AZEBAN CITY)", Item: "gold", BuyPrice: 100, Supply: 10})
+	if len(store.tradeGraphs) != 0 {
+		t.Errorf("got %d cached trade graphs after a new quote, want none", len(store.tradeGraphs))
+	}
+}
+
+func TestTradeGraphStationChanges(t *testing.T) {
+	_, cleanup := withStations(t)
+	defer cleanup()
+	store := testStore(t)
+	q := routeQuery{CreditLimit: math.MaxFloat64, JumpRange: 100, Cargo: 1, Filter: stationFilter{Pad: "L", Strict: true}}
+	if g := store.cachedTradeGraph(q); len(g) != 0 {
+		t.Fatalf("got legs from %d stations without metadata, want none", len(g))
+	}
+	for station := range store.stationSupply {
+		if err := stationInfo.put(StationInfo{Name: station, Pad: "L"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g := store.cachedTradeGraph(q); len(g) == 0 {
+		t.Error("graph not rebuilt after the station metadata changed")
+	}
+}
@@ -3,15 +3,20 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nictuku/eliteprofit/emdn"
@@ -48,32 +53,49 @@ type marketStore struct {
 	sync.Mutex
 	itemSupply map[string]*llrb.LLRB
 	itemDemand map[string]*llrb.LLRB
-	// station => item => price
-	stationSupply map[string]map[string]float64
-	stationDemand map[string]map[string]float64
+	// station => item => latest transaction
+	stationSupply map[string]map[string]emdn.Transaction
+	stationDemand map[string]map[string]emdn.Transaction
+	// item => category, e.g. "metals"
+	itemCategory map[string]string
+	// station => who updates it and how often
+	stationActivity map[string]*activity
+	// item => market impact model
+	itemImpact map[string]*itemImpact
+	// recently built trade graphs, see cachedTradeGraph
+	tradeGraphs map[string]cachedGraph
 }
 
 func newMarketStore() *marketStore {
 	return &marketStore{
-		itemSupply:    make(map[string]*llrb.LLRB),
-		itemDemand:    make(map[string]*llrb.LLRB),
-		stationSupply: make(map[string]map[string]float64),
-		stationDemand: make(map[string]map[string]float64),
+		itemSupply:      make(map[string]*llrb.LLRB),
+		itemDemand:      make(map[string]*llrb.LLRB),
+		stationSupply:   make(map[string]map[string]emdn.Transaction),
+		stationDemand:   make(map[string]map[string]emdn.Transaction),
+		itemCategory:    make(map[string]string),
+		stationActivity: make(map[string]*activity),
+		itemImpact:      make(map[string]*itemImpact),
+		tradeGraphs:     make(map[string]cachedGraph),
 	}
 }
 
 const maxItems = 5
 
-func stationPriceUpdate(m map[string]map[string]float64, station string, item string, price float64) {
-	stationPrices := m[station]
+func stationPriceUpdate(m map[string]map[string]emdn.Transaction, t emdn.Transaction) {
+	stationPrices := m[t.Station]
 	if stationPrices == nil {
-		m[station] = make(map[string]float64)
+		m[t.Station] = make(map[string]emdn.Transaction)
 	}
-	m[station][item] = price
+	m[t.Station][t.Item] = t
 }
 
 func (s marketStore) record(m emdn.Transaction) {
 	k := m.Item
+	s.recordImpact(m)
+	if m.Category != "" {
+		s.itemCategory[k] = m.Category
+	}
+	s.recordActivity(m)
 	// Demand
 	tree, ok := s.itemDemand[k]
 	if !ok {
@@ -84,7 +106,7 @@ func (s marketStore) record(m emdn.Transaction) {
 	for tree.Len() > maxItems {
 		tree.DeleteMin()
 	}
-	stationPriceUpdate(s.stationDemand, m.Station, k, m.SellPrice)
+	stationPriceUpdate(s.stationDemand, m)
 
 	// Supply
 	tree, ok = s.itemSupply[k]
@@ -99,7 +121,12 @@ func (s marketStore) record(m emdn.Transaction) {
 	for tree.Len() > maxItems {
 		tree.DeleteMax()
 	}
-	stationPriceUpdate(s.stationSupply, m.Station, k, m.BuyPrice)
+	stationPriceUpdate(s.stationSupply, m)
+	// The cached trade graphs don't have the new prices.
+	for key := range s.tradeGraphs {
+		delete(s.tradeGraphs, key)
+	}
+	alerts.check(&s, m)
 }
 
 func (s marketStore) maxDemand(item string) demtrans {
@@ -118,66 +145,661 @@ func (s marketStore) minSupply(item string) suptrans {
 	return suptrans{}
 }
 
-func (s marketStore) bestBuyHandler(w http.ResponseWriter, r *http.Request) {
+// parseSystems reads a comma-separated list of systems. Station names are
+// accepted too and stand for their system.
+func parseSystems(list string) (systems []string, err error) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		system, err := resolveSystem(name)
+		if err != nil {
+			return nil, err
+		}
+		systems = append(systems, system)
+	}
+	return systems, nil
+}
+
+// statusError is an error reported with a specific HTTP status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// errorStatus is the HTTP status for an error from a query. Unknown names are
+// reported as not found and other errors as bad requests.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *nameError:
+		return http.StatusNotFound
+	case *statusError:
+		return e.status
+	}
+	return http.StatusBadRequest
+}
+
+// queryError reports an error from a query as text. Unknown names come with
+// suggestions.
+func queryError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusAccepted {
+		w.Header().Set("Retry-After", "10")
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// parseRouteQuery reads the route search parameters shared by the HTTP
+// handlers. Missing limits default to "unlimited" and the cargo to one unit.
+// Station and system names are resolved to known ones. The caller must hold
+// the lock.
+func (s marketStore) parseRouteQuery(r *http.Request) (q routeQuery, err error) {
+	q = routeQuery{Sort: r.FormValue("sort")}
+	if _, err := lookupStrategy(q.Sort); err != nil {
+		return q, err
+	}
+	if station := r.FormValue("station"); station != "" {
+		if q.Station, err = s.resolveStation(station); err != nil {
+			return q, err
+		}
+	}
+	avoid, err := parseSystems(r.FormValue("avoid"))
+	if err != nil {
+		return q, err
+	}
+	if len(avoid) > 0 {
+		q.Constraints.Avoid = make(map[string]bool)
+		for _, star := range avoid {
+			q.Constraints.Avoid[star] = true
+		}
+	}
+	if q.Constraints.Via, err = parseSystems(r.FormValue("via")); err != nil {
+		return q, err
+	}
+	if err := q.Constraints.validate(); err != nil {
+		return q, err
+	}
+	if q.Categories, err = s.parseCategories(r.FormValue("category"), true); err != nil {
+		return q, err
+	}
+	if q.Exclude, err = s.parseCategories(r.FormValue("exclude"), false); err != nil {
+		return q, err
+	}
+	q.Filter.Pad = strings.ToUpper(r.FormValue("pad"))
+	if _, ok := padSizes[q.Filter.Pad]; q.Filter.Pad != "" && !ok {
+		return q, fmt.Errorf("invalid pad size %q, wanted S, M or L", r.FormValue("pad"))
+	}
+	q.Filter.Strict = r.FormValue("strict") != ""
+	q.Filter.MaxArrivalLs, _ = strconv.ParseFloat(r.FormValue("maxls"), 64)
+	q.CreditLimit, _ = strconv.ParseFloat(r.FormValue("cr"), 64)
+	if q.CreditLimit == 0 {
+		q.CreditLimit = math.MaxFloat64
+	}
+	q.JumpRange, _ = strconv.ParseFloat(r.FormValue("jr"), 64)
+	if q.JumpRange == 0 {
+		q.JumpRange = math.MaxFloat64
+	}
+	q.Cargo, _ = strconv.Atoi(r.FormValue("cargo"))
+	if q.Cargo <= 0 {
+		q.Cargo = 1
+	}
+	q.Limit, _ = strconv.Atoi(r.FormValue("n"))
+	return q, nil
+}
+
+const noConstrainedRoute = "no route satisfies the avoid and via constraints\n"
+
+// routeResult is the result of a /route query.
+type routeResult struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Jumps    []string `json:"jumps"`
+	Distance float64  `json:"distance"`
+}
+
+func (s marketStore) queryRoute(r *http.Request) (res routeResult, err error) {
+	q, err := s.parseRouteQuery(r)
+	if err != nil {
+		return res, err
+	}
+	if res.From, err = resolveSystem(r.FormValue("from")); err != nil {
+		return res, err
+	}
+	if res.To, err = resolveSystem(r.FormValue("to")); err != nil {
+		return res, err
+	}
+	if res.Jumps, err = constrainedRoute(res.From, res.To, q.JumpRange, q.Constraints); err != nil {
+		return res, &statusError{http.StatusNotFound, err.Error()}
+	}
+	for i := 1; i < len(res.Jumps); i++ {
+		res.Distance += distance(res.Jumps[i-1], res.Jumps[i])
+	}
+	return res, nil
+}
+
+// routeHandler shows the jumps between two systems.
+func (s marketStore) routeHandler(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
+	res, err := s.queryRoute(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	jumps := res.Jumps
+	fmt.Fprintf(w, "======== %v to %v, %d jumps =======\n", res.From, res.To, len(jumps)-1)
+	if len(jumps) == 1 {
+		fmt.Fprintf(w, "same system, no jump needed\n")
+	}
+	for i := 1; i < len(jumps); i++ {
+		fmt.Fprintf(w, "%v -> %v, %.1f LY\n", jumps[i-1], jumps[i], distance(jumps[i-1], jumps[i]))
+	}
+}
+
+// StationRoutes are the best routes from one station.
+type StationRoutes struct {
+	Station string  `json:"station"`
+	Routes  []Route `json:"routes"`
+}
+
+// writeBuyRoutes prints the routes found from a station.
+func writeBuyRoutes(w io.Writer, q routeQuery, origin StationRoutes) {
+	fmt.Fprintf(w, "======== buying from %v =======\n", origin.Station)
+	if len(origin.Routes) == 0 && !q.Constraints.empty() {
+		fmt.Fprint(w, noConstrainedRoute)
+	}
+	for i, route := range origin.Routes {
+		fmt.Fprintf(w, "%d. buy %v %v for %v and sell to %v for %v, profit %v per unit\n", i+1, route.Units, route.Item, route.BuyPrice, route.DestinationStation, route.SellPrice, route.Profit)
+		fmt.Fprintf(w, "outlay %.0f, total profit %.0f, repeat runs %d\n", route.Outlay, route.TotalProfit, route.Runs)
+		fmt.Fprintf(w, "jumps %v, range %v, distance %.1f, CR/Jump %.1f\n", route.JumpsText(), route.JumpRange, route.Distance, route.CRJump())
+		fmt.Fprintf(w, "travel time %v, CR/hour %.0f, confidence %.2f\n", route.Travel.Round(time.Second), route.CRHour(), route.Confidence)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// stationRoutes finds the best routes from a station.
+func (s marketStore) stationRoutes(q routeQuery, station string) StationRoutes {
+	q.Station = station
+	routes, _ := s.bestBuy(q)
+	if routes == nil {
+		routes = []Route{}
+	}
+	return StationRoutes{Station: station, Routes: routes}
+}
+
+// allOrigins computes the /bestbuy routes for every known station. The lock
+// is only held for one station at a time so that new market data can be
+// recorded in between.
+func (s marketStore) allOrigins(q routeQuery) []StationRoutes {
+	mu.Lock()
 	stations := make([]string, 0, len(s.stationSupply))
 	for station := range s.stationSupply {
 		stations = append(stations, station)
 	}
+	mu.Unlock()
 	sort.Strings(stations)
-	crLimit, _ := strconv.ParseFloat(r.FormValue("cr"), 64)
-	if crLimit == 0 {
-		crLimit = math.MaxFloat64
+	origins := make([]StationRoutes, 0, len(stations))
+	for _, station := range stations {
+		mu.Lock()
+		origins = append(origins, s.stationRoutes(q, station))
+		mu.Unlock()
+	}
+	return origins
+}
+
+// reports caches the /bestbuy reports of all origins. Its maximum age is
+// set from -reportMaxAge when the program starts.
+var reports = newReportCache(*reportMaxAge)
+
+// allOriginsReport returns the /bestbuy report of all origins as rendered by
+// render. Reports are cached separately for each format. The caller must hold
+// the lock.
+func (s marketStore) allOriginsReport(r *http.Request, format string, render func(io.Writer, routeQuery, []StationRoutes)) (text []byte, computed time.Time, err error) {
+	q, err := s.parseRouteQuery(r)
+	if err != nil {
+		return nil, computed, err
 	}
-	jumpRange, _ := strconv.ParseFloat(r.FormValue("jr"), 64)
-	if jumpRange == 0 {
-		jumpRange = math.MaxFloat64
+	if q.Limit <= 0 {
+		q.Limit = 5
 	}
+	params := r.URL.Query()
+	params.Del("all")
+	text, computed, ok := reports.get(format+"?"+params.Encode(), func() []byte {
+		var buf bytes.Buffer
+		render(&buf, q, s.allOrigins(q))
+		return buf.Bytes()
+	})
+	if !ok {
+		return nil, computed, &statusError{http.StatusAccepted, "the report of all origins is being computed, please retry shortly"}
+	}
+	return text, computed, nil
+}
 
+// bestBuyResult is the result of a /bestbuy query for a station or a system.
+type bestBuyResult struct {
+	q        routeQuery
+	Stations []StationRoutes `json:"stations"`
+}
+
+// queryBestBuy finds the best routes from the station named by the "station"
+// parameter, or from every station in the "system" parameter.
+func (s marketStore) queryBestBuy(r *http.Request) (res bestBuyResult, err error) {
+	if res.q, err = s.parseRouteQuery(r); err != nil {
+		return res, err
+	}
+	if res.q.Limit <= 0 {
+		res.q.Limit = 5
+	}
+	var stations []string
+	switch {
+	case res.q.Station != "":
+		stations = []string{res.q.Station}
+	case r.FormValue("system") != "":
+		system, err := resolveSystem(r.FormValue("system"))
+		if err != nil {
+			return res, err
+		}
+		if stations = s.systemStations(system); len(stations) == 0 {
+			return res, &statusError{http.StatusNotFound, fmt.Sprintf("no stations known in system %v", system)}
+		}
+	default:
+		return res, fmt.Errorf("missing station or system parameter; use all=1 for a report of all origins")
+	}
 	for _, station := range stations {
-		fmt.Fprintf(w, "======== buying from %v =======\n", station)
-		for _, route := range s.bestBuy(station, crLimit, jumpRange) {
-			fmt.Fprintf(w, "buy %v for %v and sell to %v for %v, profit %v\n", route.Item, route.BuyPrice, route.DestinationStation, route.SellPrice, route.Profit)
-			fmt.Fprintf(w, "jumps %q, range %v, distance %.1f, CR/Jump %.1f\n", route.Jumps, route.JumpRange, route.Distance, route.Profit/float64(len(route.Jumps)))
+		res.Stations = append(res.Stations, s.stationRoutes(res.q, station))
+	}
+	return res, nil
+}
+
+// bestBuyHandler shows the best routes from the station named by the
+// "station" parameter, or from every station in the "system" parameter. With
+// the "all" parameter, it shows a report for all origins which is computed
+// in the background and cached.
+func (s marketStore) bestBuyHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	if r.FormValue("all") != "" {
+		text, computed, err := s.allOriginsReport(r, "text", func(w io.Writer, q routeQuery, origins []StationRoutes) {
+			for _, origin := range origins {
+				writeBuyRoutes(w, q, origin)
+			}
+		})
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "report computed at %v\n\n", computed.Format(time.RFC1123))
+		w.Write(text)
+		return
+	}
+	res, err := s.queryBestBuy(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	for _, origin := range res.Stations {
+		writeBuyRoutes(w, res.q, origin)
+	}
+}
+
+// bestSellResult is the result of a /bestsell query.
+type bestSellResult struct {
+	q       routeQuery
+	Station string  `json:"station"`
+	Item    string  `json:"item"`
+	Qty     int     `json:"qty"`
+	Routes  []Route `json:"routes"`
+}
+
+func (s marketStore) queryBestSell(r *http.Request) (res bestSellResult, err error) {
+	if res.q, err = s.parseRouteQuery(r); err != nil {
+		return res, err
+	}
+	if res.q.Station == "" {
+		return res, fmt.Errorf("missing station parameter")
+	}
+	if res.q.Limit <= 0 {
+		res.q.Limit = 10
+	}
+	res.Station = res.q.Station
+	res.Qty, _ = strconv.Atoi(r.FormValue("qty"))
+	if res.Qty <= 0 {
+		res.Qty = 1
+	}
+	if res.Item, err = s.resolveItem(r.FormValue("item")); err != nil {
+		return res, err
+	}
+	routes, err := s.bestSell(res.q, res.Item, res.Qty)
+	if err != nil {
+		return res, &statusError{http.StatusNotFound, err.Error()}
+	}
+	if len(routes) > res.q.Limit {
+		routes = routes[:res.q.Limit]
+	}
+	res.Routes = append([]Route{}, routes...)
+	return res, nil
+}
+
+func (s marketStore) bestSellHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryBestSell(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "======== selling %d %v from %v =======\n", res.Qty, res.Item, res.Station)
+	if len(res.Routes) == 0 && !res.q.Constraints.empty() {
+		fmt.Fprint(w, noConstrainedRoute)
+	}
+	for i, route := range res.Routes {
+		fmt.Fprintf(w, "%d. sell %v to %v for %v (demand %v), revenue %v\n", i+1, route.Units, route.DestinationStation, route.SellPrice, s.stationDemand[route.DestinationStation][res.Item].Demand, route.TotalProfit)
+		fmt.Fprintf(w, "jumps %v, range %v, distance %.1f, confidence %.2f\n", route.JumpsText(), route.JumpRange, route.Distance, route.Confidence)
+	}
+}
+
+// sourceResult is the result of a /source query.
+type sourceResult struct {
+	q       routeQuery
+	Station string   `json:"station"`
+	Item    string   `json:"item"`
+	Sources []Source `json:"sources"`
+}
+
+func (s marketStore) querySource(r *http.Request) (res sourceResult, err error) {
+	if res.q, err = s.parseRouteQuery(r); err != nil {
+		return res, err
+	}
+	if res.q.Station == "" {
+		return res, fmt.Errorf("missing station parameter")
+	}
+	if res.q.Limit <= 0 {
+		res.q.Limit = 10
+	}
+	res.Station = res.q.Station
+	maxJumps, _ := strconv.Atoi(r.FormValue("maxjumps"))
+	maxPrice, _ := strconv.ParseFloat(r.FormValue("maxprice"), 64)
+	if res.Item, err = s.resolveItem(r.FormValue("item")); err != nil {
+		return res, err
+	}
+	sources, err := s.cheapestSources(res.q, res.Item, maxJumps, maxPrice)
+	if err != nil {
+		return res, &statusError{http.StatusNotFound, err.Error()}
+	}
+	if len(sources) > res.q.Limit {
+		sources = sources[:res.q.Limit]
+	}
+	res.Sources = append([]Source{}, sources...)
+	return res, nil
+}
+
+func (s marketStore) sourceHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.querySource(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "======== buying %v near %v =======\n", res.Item, res.Station)
+	if len(res.Sources) == 0 && !res.q.Constraints.empty() {
+		fmt.Fprint(w, noConstrainedRoute)
+	}
+	for i, source := range res.Sources {
+		fmt.Fprintf(w, "%d. buy from %v for %v (supply %v)\n", i+1, source.Station, source.BuyPrice, source.Supply)
+		fmt.Fprintf(w, "jumps %v, distance %.1f\n", source.JumpsText(), source.Distance)
+	}
+}
+
+// nearbyResult is the result of a /nearby query.
+type nearbyResult struct {
+	System   string          `json:"system"`
+	Radius   float64         `json:"radius"`
+	Stations []NearbyStation `json:"stations"`
+}
+
+func (s marketStore) queryNearby(r *http.Request) (res nearbyResult, err error) {
+	if res.System, err = resolveSystem(r.FormValue("system")); err != nil {
+		return res, err
+	}
+	res.Radius, _ = strconv.ParseFloat(r.FormValue("radius"), 64)
+	if res.Radius <= 0 {
+		res.Radius = 15
+	}
+	nearby, err := s.nearbyStations(res.System, res.Radius)
+	if err != nil {
+		return res, &statusError{http.StatusNotFound, err.Error()}
+	}
+	res.Stations = append([]NearbyStation{}, nearby...)
+	return res, nil
+}
+
+func (s marketStore) nearbyHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryNearby(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "======== stations within %v LY of %v =======\n", res.Radius, res.System)
+	for _, n := range res.Stations {
+		age := "unknown"
+		if !n.Updated.IsZero() {
+			age = time.Since(n.Updated).Truncate(time.Minute).String()
+		}
+		fmt.Fprintf(w, "%v, %.1f LY, last update %v ago\n", n.Station, n.Distance, age)
+	}
+}
+
+func (s marketStore) querySearch(r *http.Request) ([]nameMatch, error) {
+	limit, _ := strconv.Atoi(r.FormValue("n"))
+	if limit <= 0 {
+		limit = 10
+	}
+	return append([]nameMatch{}, s.search(r.FormValue("q"), limit)...), nil
+}
+
+// searchHandler lists the stations and systems matching the "q" parameter as
+// JSON, for autocompletion.
+func (s marketStore) searchHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	matches, _ := s.querySearch(r)
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// loopsResult is the result of a /loops query.
+type loopsResult struct {
+	q     routeQuery
+	Loops []Loop `json:"loops"`
+}
+
+func (s marketStore) queryLoops(r *http.Request) (res loopsResult, err error) {
+	if res.q, err = s.parseRouteQuery(r); err != nil {
+		return res, err
+	}
+	maxStations, _ := strconv.Atoi(r.FormValue("stations"))
+	if maxStations < 2 {
+		maxStations = 3
+	}
+	if maxStations > maxLoopStations {
+		return res, fmt.Errorf("loops of at most %d stations can be searched", maxLoopStations)
+	}
+	if res.q.Limit <= 0 {
+		res.q.Limit = 20
+	}
+	maxJumps, _ := strconv.Atoi(r.FormValue("maxjumps"))
+	if maxJumps < 0 || maxJumps > maxLoopJumps {
+		return res, fmt.Errorf("maxjumps must be between 0 and %d", maxLoopJumps)
+	}
+	res.Loops = append([]Loop{}, s.bestLoops(res.q, maxStations, maxJumps)...)
+	return res, nil
+}
+
+func (s marketStore) loopsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryLoops(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	if len(res.Loops) == 0 && !res.q.Constraints.empty() {
+		fmt.Fprint(w, noConstrainedRoute)
+	}
+	for _, loop := range res.Loops {
+		fmt.Fprintf(w, "======== %d stations, %d jumps, total profit %v =======\n", len(loop.Legs), loop.Jumps, loop.TotalProfit)
+		for _, route := range loop.Legs {
+			fmt.Fprintf(w, "at %v buy %v %v for %v and sell to %v for %v, profit %v\n", route.SourceStation, route.Units, route.Item, route.BuyPrice, route.DestinationStation, route.SellPrice, route.TotalProfit)
+			fmt.Fprintf(w, "  jumps %v, distance %.1f\n", route.JumpsText(), route.Distance)
 		}
 		fmt.Fprintf(w, "\n")
 	}
 }
 
-func (s marketStore) buyHandler(w http.ResponseWriter, r *http.Request) {
+// planResult is the result of a /plan query.
+type planResult struct {
+	q       routeQuery
+	Station string `json:"station"`
+	Plan
+	FinalCredits float64 `json:"finalCredits"`
+}
+
+func (s marketStore) queryPlan(r *http.Request) (res planResult, err error) {
+	if res.q, err = s.parseRouteQuery(r); err != nil {
+		return res, err
+	}
+	if res.q.Station == "" {
+		return res, fmt.Errorf("missing station parameter")
+	}
+	if res.q.CreditLimit == math.MaxFloat64 {
+		return res, fmt.Errorf("the starting credits must be set with the cr parameter")
+	}
+	legs, _ := strconv.Atoi(r.FormValue("legs"))
+	if legs <= 0 {
+		legs = 5
+	}
+	res.Station = res.q.Station
+	res.Plan = s.planTrades(res.q, legs)
+	if res.Plan.Legs == nil {
+		res.Plan.Legs = []Route{}
+	}
+	res.FinalCredits = res.Plan.FinalCredits()
+	return res, nil
+}
+
+func (s marketStore) planHandler(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
+	res, err := s.queryPlan(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	plan := res.Plan
+	if len(plan.Legs) == 0 && !res.q.Constraints.empty() {
+		fmt.Fprint(w, noConstrainedRoute)
+	}
+	fmt.Fprintf(w, "======== %d legs from %v, %v CR => %v CR =======\n", len(plan.Legs), res.Station, res.q.CreditLimit, res.FinalCredits)
+	for i, route := range plan.Legs {
+		fmt.Fprintf(w, "%d. at %v buy %v %v for %v and sell to %v for %v, profit %v\n", i+1, route.SourceStation, route.Units, route.Item, route.BuyPrice, route.DestinationStation, route.SellPrice, route.TotalProfit)
+		fmt.Fprintf(w, "   jumps %v, balance %v CR\n", route.JumpsText(), plan.Credits[i+1])
+	}
+}
+
+// Quote is the best price known for an item.
+type Quote struct {
+	Item    string `json:"item"`
+	Station string `json:"station"`
+	// Price is nil when no station quotes one.
+	Price *float64 `json:"price"`
+	// Quantity is the supply for /buy and the demand for /sell.
+	Quantity int       `json:"quantity"`
+	Updated  time.Time `json:"updated"`
+	// VsAverage compares the price to the galactic average, in percent. It's
+	// nil when fewer than minDealStations stations quote the item, since the
+	// average means little then.
+	VsAverage *float64 `json:"vsAverage"`
+	// Deal flags prices more than -dealPercent better than the average.
+	Deal bool `json:"deal"`
+}
+
+func (q Quote) priceText() string {
+	if q.Price == nil {
+		return "N/A"
+	}
+	if q.VsAverage == nil {
+		return fmt.Sprintf("%v CR, average n/a", *q.Price)
+	}
+	return fmt.Sprintf("%v CR, %v", *q.Price, vsAverageText(*q.VsAverage, q.Deal))
+}
+
+// queryBuy finds the cheapest station selling each item.
+func (s marketStore) queryBuy(r *http.Request) ([]Quote, error) {
 	items := make([]string, 0, len(s.itemSupply))
 	for station := range s.itemSupply {
 		items = append(items, station)
 	}
 	sort.Strings(items)
+	stats := s.itemStats()
+	quotes := make([]Quote, 0, len(items))
 	for _, item := range items {
 		bestPrice := s.minSupply(item)
-		p := fmt.Sprintf("%v CR", bestPrice.BuyPrice)
-		if bestPrice.BuyPrice == math.MaxInt64 {
-			p = "N/A"
+		q := Quote{Item: item, Station: bestPrice.Station, Quantity: bestPrice.Supply, Updated: bestPrice.Timestamp}
+		if price := bestPrice.BuyPrice; price != math.MaxInt64 {
+			q.Price = &price
+			if t := emdn.Transaction(bestPrice); buyQuote(t) && stats[item].Buy.Count >= minDealStations {
+				p := newStationPrice(stats[item], t, "buy")
+				q.VsAverage, q.Deal = &p.VsAverage, p.Deal
+			}
 		}
-		fmt.Fprintf(w, "%v: best place to buy from: %v, for %v (supply %v)\n", item, bestPrice.Station, p, bestPrice.Supply)
+		quotes = append(quotes, q)
 	}
+	return quotes, nil
 }
 
-func (s marketStore) sellHandler(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
+// querySell finds the best paying station for each item.
+func (s marketStore) querySell(r *http.Request) ([]Quote, error) {
 	items := make([]string, 0, len(s.itemDemand))
 	for station := range s.itemDemand {
 		items = append(items, station)
 	}
 	sort.Strings(items)
+	stats := s.itemStats()
+	quotes := make([]Quote, 0, len(items))
 	for _, item := range items {
 		bestPrice := s.maxDemand(item)
-		p := fmt.Sprintf("%v CR", bestPrice.SellPrice)
-		if bestPrice.BuyPrice == math.MaxInt64 {
-			p = "N/A"
+		q := Quote{Item: item, Station: bestPrice.Station, Quantity: bestPrice.Demand, Updated: bestPrice.Timestamp}
+		if price := bestPrice.SellPrice; bestPrice.BuyPrice != math.MaxInt64 {
+			q.Price = &price
+			if t := emdn.Transaction(bestPrice); sellQuote(t) && stats[item].Sell.Count >= minDealStations {
+				p := newStationPrice(stats[item], t, "sell")
+				q.VsAverage, q.Deal = &p.VsAverage, p.Deal
+			}
 		}
-		fmt.Fprintf(w, "%v: best place to sell to: %v, for %v (demand %v)\n", item, bestPrice.Station, p, bestPrice.Demand)
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
+
+func (s marketStore) buyHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	quotes, _ := s.queryBuy(r)
+	for _, q := range quotes {
+		fmt.Fprintf(w, "%v: best place to buy from: %v, for %v (supply %v)\n", q.Item, q.Station, q.priceText(), q.Quantity)
+	}
+}
+
+func (s marketStore) sellHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	quotes, _ := s.querySell(r)
+	for _, q := range quotes {
+		fmt.Fprintf(w, "%v: best place to sell to: %v, for %v (demand %v)\n", q.Item, q.Station, q.priceText(), q.Quantity)
 	}
 }
 
@@ -203,11 +825,25 @@ func (t demtrans) Less(item llrb.Item) bool {
 
 func (t demtrans) Type() string { return "Demand" }
 
-var mu sync.Mutex
+var mu timedMutex
 
 func main() {
 	flag.Parse()
+	reports.maxAge = *reportMaxAge
 	store := newMarketStore()
+	if err := stationInfo.load(*stationsFile); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		if err := cmd(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	var sub func() (<-chan emdn.Message, error)
 	// XXX: HTTP handlers and zeromq are racing.
@@ -222,13 +858,40 @@ func main() {
 		}
 		sub = emdn.Subscribe
 	}
+	// Rules are loaded after the cache, whose old quotes aren't news.
+	if err := alerts.load(*alertsFile); err != nil {
+		log.Fatal(err)
+	}
+	go alerts.deliver(&http.Client{Timeout: 10 * time.Second})
 
-	http.HandleFunc("/bestbuy", store.bestBuyHandler)
-	http.HandleFunc("/buy", store.buyHandler)
-
-	http.HandleFunc("/sell", store.sellHandler)
+	handle("/bestbuy", store.bestBuyHandler)
+	handle("/bestsell", store.bestSellHandler)
+	handle("/loops", store.loopsHandler)
+	handle("/nearby", store.nearbyHandler)
+	handle("/source", store.sourceHandler)
+	handle("/plan", store.planHandler)
+	handle("/route", store.routeHandler)
+	handle("/search", store.searchHandler)
+	handle("/impact", store.impactHandler)
+	handle("/coverage", store.coverageHandler)
+	handle("/categories", store.categoriesHandler)
+	handle("/stats", store.statsHandler)
+	http.HandleFunc("/stream", store.streamHandler)
+	handle("/api/v1/", store.apiHandler)
+	handle("/", store.uiIndexHandler)
+	handle("/ui/route", store.uiRouteHandler)
+	handle("/ui/prices", store.uiPricesHandler)
+	handle("/static/", staticHandler)
+	handle("/admin/stations", stationsAdminHandler)
+	handle("/alerts", store.alertsHandler)
+	handle("/buy", store.buyHandler)
+	handle("/sell", store.sellHandler)
+	http.HandleFunc("/metrics", store.metricsHandler)
 	go func() {
-		for {
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 {
+				atomic.AddInt64(&reconnects, 1)
+			}
 			c, err := sub()
 			if err != nil {
 				log.Println(err)
@@ -239,9 +902,10 @@ func main() {
 				mu.Lock()
 				store.record(m.Transaction)
 				mu.Unlock()
+				stream.publish(m.Transaction)
 			}
-			// c isn't expected to close unless in test mode. But if it
-			// does, restart the subscription.
+			// c closes at the end of the test input or when the
+			// connection fails. Restart the subscription.
 			time.Sleep(30 * time.Second)
 		}
 	}()
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+// timedMutex is a sync.Mutex that measures how long Lock waits. The totals
+// are only updated and read with the lock held.
+type timedMutex struct {
+	sync.Mutex
+	wait  time.Duration
+	locks int64
+}
+
+func (m *timedMutex) Lock() {
+	start := time.Now()
+	m.Mutex.Lock()
+	m.wait += time.Since(start)
+	m.locks++
+}
+
+// reconnects counts the EMDN subscriptions after the first one.
+var reconnects int64
+
+// latencyBuckets are the upper bounds of the query latency histograms, in
+// seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations in latencyBuckets. The last count is for
+// observations above every bucket.
+type histogram struct {
+	counts []int64
+	sum    float64
+	n      int64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	h.counts[sort.SearchFloat64s(latencyBuckets, v)]++
+	h.sum += v
+	h.n++
+}
+
+// queryLatencies keeps a histogram of the response times of each endpoint.
+type queryLatencies struct {
+	sync.Mutex
+	endpoints map[string]*histogram
+}
+
+var latencies = &queryLatencies{endpoints: make(map[string]*histogram)}
+
+func (l *queryLatencies) observe(endpoint string, d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	h := l.endpoints[endpoint]
+	if h == nil {
+		h = new(histogram)
+		l.endpoints[endpoint] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// timed records the response times of a handler under the endpoint's name.
+func timed(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		latencies.observe(endpoint, time.Since(start))
+	}
+}
+
+// handle registers a handler whose response times are measured.
+func handle(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, timed(pattern, h))
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeLatencies prints the query latency histograms in the Prometheus text
+// format, by endpoint.
+func (l *queryLatencies) write(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+	const name = "eliteprofit_query_duration_seconds"
+	writeMetricHeader(w, name, "histogram", "Time taken to answer queries, by endpoint.")
+	var endpoints []string
+	for endpoint := range l.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		h := l.endpoints[endpoint]
+		label := strconv.Quote(endpoint)
+		var cumulative int64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%v_bucket{endpoint=%v,le=\"%v\"} %d\n", name, label, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket{endpoint=%v,le=\"+Inf\"} %d\n", name, label, h.n)
+		fmt.Fprintf(w, "%v_sum{endpoint=%v} %v\n", name, label, formatFloat(h.sum))
+		fmt.Fprintf(w, "%v_count{endpoint=%v} %d\n", name, label, h.n)
+	}
+}
+
+// metricsHandler exports the health of the feed, the size of the store and
+// the query latencies in the Prometheus text format.
+func (s marketStore) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	stations, items := len(s.stationNames()), len(s.itemNames())
+	wait, locks := mu.wait, mu.locks
+	mu.Unlock()
+	feed := emdn.Stats.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counters := []struct {
+		name, help string
+		v          int64
+	}{
+		{"eliteprofit_emdn_messages_received_total", "EMDN messages received.", feed.Received},
+		{"eliteprofit_emdn_messages_decoded_total", "EMDN messages decoded.", feed.Decoded},
+		{"eliteprofit_emdn_messages_rejected_total", "EMDN messages that couldn't be decoded.", feed.Rejected},
+		{"eliteprofit_emdn_messages_deduped_total", "Duplicate EMDN messages dropped.", feed.Deduped},
+		{"eliteprofit_emdn_reconnects_total", "EMDN subscriptions after the first one.", atomic.LoadInt64(&reconnects)},
+	}
+	for _, c := range counters {
+		writeMetricHeader(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%v %d\n", c.name, c.v)
+	}
+	writeMetricHeader(w, "eliteprofit_stations", "gauge", "Stations with known prices.")
+	fmt.Fprintf(w, "eliteprofit_stations %d\n", stations)
+	writeMetricHeader(w, "eliteprofit_items", "gauge", "Items with known prices.")
+	fmt.Fprintf(w, "eliteprofit_items %d\n", items)
+	writeMetricHeader(w, "eliteprofit_lock_wait_seconds", "summary", "Time spent waiting for the market store lock.")
+	fmt.Fprintf(w, "eliteprofit_lock_wait_seconds_sum %v\n", formatFloat(wait.Seconds()))
+	fmt.Fprintf(w, "eliteprofit_lock_wait_seconds_count %d\n", locks)
+	latencies.write(w)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []float64{0.001, 0.005, 0.2, 60} {
+		h.observe(v)
+	}
+	// Buckets are inclusive upper bounds.
+	if h.counts[0] != 2 || h.counts[5] != 1 || h.counts[len(latencyBuckets)] != 1 || h.n != 4 {
+		t.Errorf("got %+v", h)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	store := testStore(t)
+	old := latencies
+	latencies = &queryLatencies{endpoints: make(map[string]*histogram)}
+	defer func() { latencies = old }()
+	h := timed("/test-timed", func(w http.ResponseWriter, r *http.Request) {})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/test-timed", nil))
+	latencies.observe("/test-slow", 20*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	store.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE eliteprofit_emdn_messages_received_total counter\n",
+		"eliteprofit_emdn_messages_deduped_total ",
+		"eliteprofit_emdn_reconnects_total 0\n",
+		"eliteprofit_lock_wait_seconds_count ",
+		`eliteprofit_query_duration_seconds_bucket{endpoint="/test-slow",le="0.01"} 0` + "\n",
+		`eliteprofit_query_duration_seconds_bucket{endpoint="/test-slow",le="0.025"} 1` + "\n",
+		`eliteprofit_query_duration_seconds_count{endpoint="/test-slow"} 1` + "\n",
+		`eliteprofit_query_duration_seconds_bucket{endpoint="/test-timed",le="+Inf"} 1` + "\n",
+		`eliteprofit_query_duration_seconds_count{endpoint="/test-timed"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%v", want, body)
+		}
+	}
+	if strings.Contains(body, "eliteprofit_stations 0\n") || strings.Contains(body, "eliteprofit_items 0\n") {
+		t.Errorf("store sizes not reported:\n%v", body)
+	}
+}
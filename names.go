@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nictuku/eliteprofit/emdn"
+	"github.com/petar/GoLLRB/llrb"
+)
+
+// nameError reports a name that couldn't be resolved, with the closest known
+// names as suggestions.
+type nameError struct {
+	Kind        string // "station", "system" or "item".
+	Name        string
+	Suggestions []string
+	Ambiguous   bool
+}
+
+func (e *nameError) Error() string {
+	msg := fmt.Sprintf("unknown %v %q", e.Kind, e.Name)
+	if e.Ambiguous {
+		msg = fmt.Sprintf("%v %q is ambiguous", e.Kind, e.Name)
+	}
+	if len(e.Suggestions) > 0 {
+		msg += "; did you mean " + strings.Join(e.Suggestions, ", ") + "?"
+	}
+	return msg
+}
+
+// maxSuggestions limits the names offered in "did you mean" errors.
+const maxSuggestions = 5
+
+// resolveName finds the name a user meant among the known names. Names are
+// matched exactly first, then ignoring case, then as a unique prefix and
+// finally as a unique substring, so "azeban" finds "Eranin (AZEBAN CITY)".
+// Otherwise the error suggests the closest names.
+func resolveName(kind string, name string, known []string) (string, error) {
+	lower := strings.ToLower(strings.TrimSpace(name))
+	if lower == "" {
+		return "", fmt.Errorf("missing %v name", kind)
+	}
+	var equal, prefix, substring []string
+	for _, k := range known {
+		if k == name {
+			return k, nil
+		}
+		l := strings.ToLower(k)
+		switch {
+		case l == lower:
+			equal = append(equal, k)
+		case strings.HasPrefix(l, lower):
+			prefix = append(prefix, k)
+		case strings.Contains(l, lower):
+			substring = append(substring, k)
+		}
+	}
+	for _, matches := range [][]string{equal, prefix, substring} {
+		switch {
+		case len(matches) == 1:
+			return matches[0], nil
+		case len(matches) > 1:
+			sort.Strings(matches)
+			if len(matches) > maxSuggestions {
+				matches = matches[:maxSuggestions]
+			}
+			return "", &nameError{Kind: kind, Name: name, Suggestions: matches, Ambiguous: true}
+		}
+	}
+	var suggestions []string
+	for _, m := range matchNames(name, known) {
+		suggestions = append(suggestions, m.Name)
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+	}
+	return "", &nameError{Kind: kind, Name: name, Suggestions: suggestions}
+}
+
+// nameMatch is a known name matching a search query.
+type nameMatch struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// score ranks the matches, lower is better.
+	score int
+}
+
+// Match scores. Typos add their edit distance to scoreTypo.
+const (
+	scoreEqual = iota
+	scorePrefix
+	scoreWordPrefix
+	scoreSubstring
+	scoreTypo
+)
+
+// matchNames finds the known names matching query, best first. Besides case
+// insensitive prefix and substring matches, names within a small edit
+// distance of the query are included, so typos still find something. For
+// autocompletion, the query is also compared with the start of each name,
+// give or take the typos.
+func matchNames(query string, known []string) (matches []nameMatch) {
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" {
+		return nil
+	}
+	rq := []rune(q)
+	maxTypos := len(rq) / 4
+	if maxTypos < 1 {
+		maxTypos = 1
+	}
+	for _, name := range known {
+		l := strings.ToLower(name)
+		score := -1
+		switch {
+		case l == q:
+			score = scoreEqual
+		case strings.HasPrefix(l, q):
+			score = scorePrefix
+		case strings.Contains(l, " "+q) || strings.Contains(l, "("+q):
+			score = scoreWordPrefix
+		case strings.Contains(l, q):
+			score = scoreSubstring
+		default:
+			d := editDistance(q, l)
+			// Typos that add or drop letters shift the end of the prefix,
+			// so try every length they allow.
+			rl := []rune(l)
+			n := len(rq) - maxTypos
+			if n < 1 {
+				n = 1
+			}
+			for ; n <= len(rq)+maxTypos && n < len(rl); n++ {
+				if p := editDistance(q, string(rl[:n])); p < d {
+					d = p
+				}
+			}
+			if d <= maxTypos {
+				score = scoreTypo + d
+			}
+		}
+		if score >= 0 {
+			matches = append(matches, nameMatch{Name: name, score: score})
+		}
+	}
+	sort.Sort(matchesByScore(matches))
+	return matches
+}
+
+type matchesByScore []nameMatch
+
+func (m matchesByScore) Len() int      { return len(m) }
+func (m matchesByScore) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matchesByScore) Less(i, j int) bool {
+	if m[i].score != m[j].score {
+		return m[i].score < m[j].score
+	}
+	return m[i].Name < m[j].Name
+}
+
+// editDistance is the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// stationNames lists every station with market data.
+func (s marketStore) stationNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range []map[string]map[string]emdn.Transaction{s.stationSupply, s.stationDemand} {
+		for station := range m {
+			if !seen[station] {
+				seen[station] = true
+				names = append(names, station)
+			}
+		}
+	}
+	return names
+}
+
+// itemNames lists every item with market data.
+func (s marketStore) itemNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range []map[string]*llrb.LLRB{s.itemSupply, s.itemDemand} {
+		for item := range m {
+			if !seen[item] {
+				seen[item] = true
+				names = append(names, item)
+			}
+		}
+	}
+	return names
+}
+
+func systemNames() []string {
+	names := make([]string, 0, len(locs))
+	for system := range locs {
+		names = append(names, system)
+	}
+	return names
+}
+
+func (s marketStore) resolveStation(name string) (string, error) {
+	return resolveName("station", name, s.stationNames())
+}
+
+func (s marketStore) resolveItem(name string) (string, error) {
+	return resolveName("item", name, s.itemNames())
+}
+
+// resolveSystem finds a system by name. A station name stands for its system.
+func resolveSystem(name string) (string, error) {
+	system := star(name)
+	if _, ok := locs[system]; ok {
+		return system, nil
+	}
+	return resolveName("system", system, systemNames())
+}
+
+// search finds the stations and systems matching a query, best first, for
+// autocompletion.
+func (s marketStore) search(query string, limit int) []nameMatch {
+	stations := matchNames(query, s.stationNames())
+	for i := range stations {
+		stations[i].Kind = "station"
+	}
+	systems := matchNames(query, systemNames())
+	for i := range systems {
+		systems[i].Kind = "system"
+	}
+	matches := append(stations, systems...)
+	sort.Stable(matchesByScore(matches))
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"eranin", "eranin", 0},
+		{"erannin", "eranin", 1},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d; want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestResolveSuggestions(t *testing.T) {
+	_, err := resolveSystem("Erannin")
+	if err == nil {
+		t.Fatalf("resolveSystem(Erannin) succeeded")
+	}
+	if e, ok := err.(*nameError); !ok || len(e.Suggestions) == 0 || e.Suggestions[0] != "Eranin" {
+		t.Errorf("resolveSystem(Erannin) error %v; wanted a suggestion of Eranin", err)
+	}
+	if got, err := resolveSystem("eranin (azeban city)"); err != nil || got != "Eranin" {
+		t.Errorf("resolveSystem(station name) = %q, %v; want Eranin", got, err)
+	}
+	if _, err := resolveSystem(" "); err == nil {
+		t.Errorf("resolveSystem of an empty name succeeded")
+	}
+}
+
+func TestMatchPrefixTypos(t *testing.T) {
+	known := []string{"Asellus Primus (BEAGLE 2 LANDING)", "Eranin (AZEBAN CITY)", "Ωμέγα (ÅNGSTRÖM PORT)"}
+	var tests = []struct {
+		query, want string
+	}{
+		// A letter too many, too few or swapped at the start of the name.
+		{"Erannin", "Eranin (AZEBAN CITY)"},
+		{"aselus", "Asellus Primus (BEAGLE 2 LANDING)"},
+		{"Eranim", "Eranin (AZEBAN CITY)"},
+		// Letters, not bytes.
+		{"Ωμγα", "Ωμέγα (ÅNGSTRÖM PORT)"},
+	}
+	for _, test := range tests {
+		matches := matchNames(test.query, known)
+		if len(matches) != 1 || matches[0].Name != test.want {
+			t.Errorf("matchNames(%q) = %+v; want %v", test.query, matches, test.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	store := testStore(t)
+	matches := store.search("eran", 10)
+	if len(matches) == 0 {
+		t.Fatalf("search(eran) found nothing")
+	}
+	for _, m := range matches[:2] {
+		if !strings.HasPrefix(strings.ToLower(m.Name), "eran") {
+			t.Errorf("search(eran): got %+v before the prefix matches", m)
+		}
+	}
+	if matches := store.search("eran", 1); len(matches) != 1 {
+		t.Errorf("search(eran, 1) returned %d matches", len(matches))
+	}
+	if matches := store.search("", 10); len(matches) != 0 {
+		t.Errorf("search() returned %v", matches)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+// NearbyStation is a known station close to a system.
+type NearbyStation struct {
+	Station  string  `json:"station"`
+	Distance float64 `json:"distance"`
+	// Updated is the time of the station's most recent quote.
+	Updated time.Time `json:"updated"`
+}
+
+// lastUpdate returns the time of the most recent quote from a station.
+func (s marketStore) lastUpdate(station string) (last time.Time) {
+	for _, m := range []map[string]map[string]emdn.Transaction{s.stationSupply, s.stationDemand} {
+		for _, t := range m[station] {
+			if t.Timestamp.After(last) {
+				last = t.Timestamp
+			}
+		}
+	}
+	return last
+}
+
+// nearbyStations lists the stations with market data within radius LY of a
+// system, closest first.
+func (s marketStore) nearbyStations(system string, radius float64) ([]NearbyStation, error) {
+	loc, ok := locs[system]
+	if !ok {
+		return nil, fmt.Errorf("unknown system: %v", system)
+	}
+	seen := make(map[string]bool)
+	var nearby []NearbyStation
+	for _, m := range []map[string]map[string]emdn.Transaction{s.stationSupply, s.stationDemand} {
+		for station := range m {
+			if seen[station] {
+				continue
+			}
+			seen[station] = true
+			stationLoc, ok := locs[star(station)]
+			if !ok {
+				continue
+			}
+			if d := loc.Distance(stationLoc); d <= radius {
+				nearby = append(nearby, NearbyStation{Station: station, Distance: d, Updated: s.lastUpdate(station)})
+			}
+		}
+	}
+	sort.Sort(stationsByDistance(nearby))
+	return nearby, nil
+}
+
+type stationsByDistance []NearbyStation
+
+func (s stationsByDistance) Len() int      { return len(s) }
+func (s stationsByDistance) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s stationsByDistance) Less(i, j int) bool {
+	if s[i].Distance != s[j].Distance {
+		return s[i].Distance < s[j].Distance
+	}
+	return s[i].Station < s[j].Station
+}
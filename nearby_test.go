@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNearbyStations(t *testing.T) {
+	store := testStore(t)
+	nearby, err := store.nearbyStations("Eranin", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearby) == 0 {
+		t.Fatalf("no stations near Eranin")
+	}
+	if nearby[0].Station != "Eranin (AZEBAN CITY)" || nearby[0].Distance != 0 {
+		t.Errorf("closest station %+v, wanted Eranin (AZEBAN CITY)", nearby[0])
+	}
+	for i, n := range nearby {
+		if n.Distance > 10 {
+			t.Errorf("%v is %v LY away", n.Station, n.Distance)
+		}
+		if i > 0 && n.Distance < nearby[i-1].Distance {
+			t.Errorf("stations not sorted by distance at %d", i)
+		}
+		if n.Updated.IsZero() {
+			t.Errorf("%v: no update time", n.Station)
+		}
+	}
+	if _, err := store.nearbyStations("Bogus", 10); err == nil {
+		t.Errorf("unknown system accepted")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+// Plan is a sequence of trades where the profit of each leg is reinvested in
+// the next one.
+type Plan struct {
+	Legs []Route `json:"legs"`
+	// Credits is the balance after each leg.
+	Credits []float64 `json:"credits"`
+}
+
+// FinalCredits is the balance at the end of the plan.
+func (p Plan) FinalCredits() float64 {
+	return p.Credits[len(p.Credits)-1]
+}
+
+// planTrades finds the sequence of up to legs trades starting from the query's
+// station with q.CreditLimit credits that ends with the most credits. Each leg
+// is limited by the balance at the time, so an early trade with a smaller
+// profit can win if it unlocks more expensive cargo later.
+//
+// Since the options available after a leg only depend on the station and the
+// balance, only the richest plan ending at each station needs to be kept
+// after each leg.
+func (s marketStore) planTrades(q routeQuery, legs int) Plan {
+	best := Plan{Credits: []float64{q.CreditLimit}}
+	// station => richest plan ending there.
+	plans := map[string]Plan{q.Station: best}
+	for leg := 0; leg < legs && len(plans) > 0; leg++ {
+		next := make(map[string]Plan)
+		for at, p := range plans {
+			balance := p.FinalCredits()
+			q.Station, q.CreditLimit = at, balance
+			routes, _ := s.bestBuy(q)
+			for _, route := range routes {
+				to := route.DestinationStation
+				if n, ok := next[to]; ok && n.FinalCredits() >= balance+route.TotalProfit {
+					continue
+				}
+				n := Plan{
+					Legs:    make([]Route, 0, len(p.Legs)+1),
+					Credits: make([]float64, 0, len(p.Credits)+1),
+				}
+				n.Legs = append(append(n.Legs, p.Legs...), route)
+				n.Credits = append(append(n.Credits, p.Credits...), balance+route.TotalProfit)
+				next[to] = n
+				if n.FinalCredits() > best.FinalCredits() {
+					best = n
+				}
+			}
+		}
+		plans = next
+	}
+	return best
+}
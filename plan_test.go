@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlanTrades(t *testing.T) {
+	store := testStore(t)
+	station := "Asellus Primus (BEAGLE 2 LANDING)"
+	plan := store.planTrades(routeQuery{Station: station, CreditLimit: 1000, JumpRange: 100, Cargo: 20}, 4)
+	if len(plan.Legs) != 4 {
+		t.Fatalf("got %d legs, wanted 4", len(plan.Legs))
+	}
+	if plan.Legs[0].SourceStation != station {
+		t.Errorf("plan starts at %v, wanted %v", plan.Legs[0].SourceStation, station)
+	}
+	for i, leg := range plan.Legs {
+		if leg.Outlay > plan.Credits[i] {
+			t.Errorf("leg %d costs %v, but the balance was %v", i, leg.Outlay, plan.Credits[i])
+		}
+		if plan.Credits[i+1] != plan.Credits[i]+leg.TotalProfit {
+			t.Errorf("leg %d: balance %v, wanted %v", i, plan.Credits[i+1], plan.Credits[i]+leg.TotalProfit)
+		}
+		if i > 0 && leg.SourceStation != plan.Legs[i-1].DestinationStation {
+			t.Errorf("leg %d starts at %v, but the previous ended at %v", i, leg.SourceStation, plan.Legs[i-1].DestinationStation)
+		}
+	}
+
+	// Reinvesting must do at least as well as repeating the best first trade
+	// greedily.
+	greedy := 1000.0
+	at := station
+	for i := 0; i < 4; i++ {
+		routes, _ := store.bestBuy(routeQuery{Station: at, CreditLimit: greedy, JumpRange: 100, Cargo: 20, Limit: 1})
+		if len(routes) == 0 {
+			break
+		}
+		greedy += routes[0].TotalProfit
+		at = routes[0].DestinationStation
+	}
+	if plan.FinalCredits() < greedy {
+		t.Errorf("plan ends with %v CR, greedy trading gets %v CR", plan.FinalCredits(), greedy)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	reportMaxAge = flag.Duration("reportMaxAge", 5*time.Minute, "how long the /bestbuy report of all origins is served before being recomputed in the background")
+)
+
+// maxReports limits the number of parameter combinations cached.
+const maxReports = 20
+
+// report is the cached output of an expensive query.
+type report struct {
+	computed time.Time
+	text     []byte
+	// pending is true while the report is being computed.
+	pending bool
+}
+
+// reportCache holds reports that are too slow to compute while the user
+// waits. Reports are computed in the background and served until they are
+// older than maxAge, at which point a fresh one is computed while the old one
+// is still served.
+type reportCache struct {
+	sync.Mutex
+	maxAge  time.Duration
+	reports map[string]*report
+}
+
+func newReportCache(maxAge time.Duration) *reportCache {
+	return &reportCache{maxAge: maxAge, reports: make(map[string]*report)}
+}
+
+// get returns the report for key if one is available. It starts computing
+// the report in the background if it's missing or stale.
+func (c *reportCache) get(key string, compute func() []byte) (text []byte, computed time.Time, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.reports[key]
+	if !ok {
+		c.evict()
+		r = &report{}
+		c.reports[key] = r
+	}
+	if !r.pending && (r.computed.IsZero() || time.Since(r.computed) > c.maxAge) {
+		r.pending = true
+		go func() {
+			text := compute()
+			c.Lock()
+			defer c.Unlock()
+			r.text, r.computed, r.pending = text, time.Now(), false
+		}()
+	}
+	return r.text, r.computed, !r.computed.IsZero()
+}
+
+// evict makes room for a new report by removing the oldest ones. The caller
+// must hold the lock.
+func (c *reportCache) evict() {
+	for len(c.reports) >= maxReports {
+		var oldest string
+		var oldestTime time.Time
+		for key, r := range c.reports {
+			if r.pending {
+				continue
+			}
+			if oldest == "" || r.computed.Before(oldestTime) {
+				oldest, oldestTime = key, r.computed
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		delete(c.reports, oldest)
+	}
+}
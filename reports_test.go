@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportCache(t *testing.T) {
+	c := newReportCache(time.Hour)
+	release := make(chan bool)
+	computed := make(chan bool, 10)
+	compute := func() []byte {
+		<-release
+		computed <- true
+		return []byte("report")
+	}
+	if _, _, ok := c.get("key", compute); ok {
+		t.Fatalf("report available before being computed")
+	}
+	// A second request doesn't start another computation.
+	c.get("key", compute)
+	release <- true
+	<-computed
+
+	// The cache is updated right after compute returns.
+	var text []byte
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		text, _, ok = c.get("key", compute)
+		time.Sleep(time.Millisecond)
+	}
+	if !ok || string(text) != "report" {
+		t.Fatalf("got %q, %v; want the computed report", text, ok)
+	}
+	select {
+	case <-computed:
+		t.Errorf("report computed twice")
+	default:
+	}
+}
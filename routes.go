@@ -2,78 +2,375 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"code.google.com/p/gos2/r3"
 )
 
 type Route struct {
-	Item               string
-	SourceStation      string
-	BuyPrice           float64
-	DestinationStation string
-	SellPrice          float64
-	Profit             float64
-	Distance           float64
-	JumpRange          float64
-	Jumps              []string
+	Item               string        `json:"item"`
+	Category           string        `json:"category"`
+	SourceStation      string        `json:"sourceStation"`
+	BuyPrice           float64       `json:"buyPrice"`
+	DestinationStation string        `json:"destinationStation"`
+	SellPrice          float64       `json:"sellPrice"`
+	Profit             float64       `json:"profit"`      // Per unit, at the quoted prices.
+	Units              int           `json:"units"`       // Limited by cargo, credits, stock and market impact.
+	Outlay             float64       `json:"outlay"`      // Cost of the whole load.
+	TotalProfit        float64       `json:"totalProfit"` // Profit for the whole load, unit by unit.
+	Distance           float64       `json:"distance"`
+	JumpRange          float64       `json:"jumpRange"`
+	Jumps              []string      `json:"jumps"` // Stars visited, including the origin.
+	Travel             time.Duration `json:"-"`     // Estimated from the travel model.
+	// Confidence scores the freshness and corroboration of the prices the
+	// route relies on, from 0 to 1.
+	Confidence float64 `json:"confidence"`
+	// Runs estimates how many times the route can be repeated before the
+	// prices move too much for it to pay.
+	Runs int `json:"runs"`
 }
 
 // localItems finds all items with positive supply from a station that cost up
 // to creditLimit.
 func (s marketStore) localItems(station string, creditLimit float64) (items []Route) {
-	for item, price := range s.stationSupply[station] {
-		if price <= creditLimit {
-			items = append(items, Route{Item: item, BuyPrice: price})
+	for item, t := range s.stationSupply[station] {
+		if t.BuyPrice <= creditLimit {
+			items = append(items, Route{Item: item, BuyPrice: t.BuyPrice})
 		}
 	}
 	return items
 }
 
-// bestBuy finds the route with maximum profit based on arguments. It currently
-// only considers buying from local items and assumes a uniform travel cost -
-// i.e: assumes that all systems are one jump away.
-func (s marketStore) bestBuy(currentStation string, creditLimit float64, jumpRange float64) (routes []Route) {
-	// Find top profit for each item.
-	var bestProfit, profit float64
-	var crjump, bestCRJump float64
-
-	var bestRoute Route
-	for _, item := range s.localItems(currentStation, creditLimit) {
-		// TODO: Consider distance and cargoLimit.
-		bestPrice := s.maxDemand(item.Item)
-		profit = bestPrice.SellPrice - item.BuyPrice
-		if profit > bestProfit {
-			jumps, err := starRoute(star(currentStation), star(bestPrice.Station), jumpRange)
-			if err != nil {
+// loadUnits returns how many units of an item priced at price fit in a cargo
+// hold, given a credit limit and the stock available for sale.
+func loadUnits(cargo int, creditLimit float64, price float64, stock int) int {
+	units := cargo
+	if stock < units {
+		units = stock
+	}
+	if price > 0 && creditLimit/price < float64(units) {
+		units = int(creditLimit / price)
+	}
+	if units < 0 {
+		return 0
+	}
+	return units
+}
+
+// routeQuery holds the parameters of a route search from a station.
+type routeQuery struct {
+	Station     string
+	CreditLimit float64
+	JumpRange   float64
+	Cargo       int
+	// Limit is the maximum number of routes returned. Zero means no limit.
+	Limit int
+	// Sort is the name of a registered Strategy. Empty means "profit".
+	Sort string
+	// Filter restricts the destination stations.
+	Filter stationFilter
+	// Constraints restrict the stars visited on the way.
+	Constraints routeConstraints
+	// Categories restrict the items carried to these categories, unless
+	// empty. Exclude bans categories, e.g. illegal goods.
+	Categories map[string]bool
+	Exclude    map[string]bool
+}
+
+// allowsCategory reports whether items of a category may be carried.
+func (q routeQuery) allowsCategory(category string) bool {
+	return (len(q.Categories) == 0 || q.Categories[category]) && !q.Exclude[category]
+}
+
+// JumpCount is the number of hyperspace jumps in the route.
+func (r Route) JumpCount() int {
+	if len(r.Jumps) == 0 {
+		return 0
+	}
+	return len(r.Jumps) - 1
+}
+
+// SameSystem reports whether the route stays within a single star system and
+// thus needs no hyperspace jump.
+func (r Route) SameSystem() bool {
+	return len(r.Jumps) == 1
+}
+
+// JumpsText describes the stars visited on the route.
+func (r Route) JumpsText() string {
+	if r.SameSystem() {
+		return fmt.Sprintf("none, same system (%v)", r.Jumps[0])
+	}
+	return fmt.Sprintf("%q", r.Jumps)
+}
+
+// CRJump is the total profit divided by the number of hyperspace jumps. Routes
+// within a system count as a single jump.
+func (r Route) CRJump() float64 {
+	n := r.JumpCount()
+	if n == 0 {
+		n = 1
+	}
+	return r.TotalProfit / float64(n)
+}
+
+// CRLY is the total profit per light year travelled. Routes within a system
+// count as a single light year.
+func (r Route) CRLY() float64 {
+	if r.Distance < 1 {
+		return r.TotalProfit
+	}
+	return r.TotalProfit / r.Distance
+}
+
+// CRHour is the total profit per hour of travel.
+func (r Route) CRHour() float64 {
+	if r.Travel <= 0 {
+		return 0
+	}
+	return r.TotalProfit / r.Travel.Hours()
+}
+
+// jumpCache memoizes constrainedRoute results for a single jump range and
+// set of constraints.
+type jumpCache struct {
+	jumpRange   float64
+	constraints routeConstraints
+	// star => star => jumps. Unreachable destinations are stored as nil.
+	routes map[string]map[string][]string
+}
+
+func newJumpCache(jumpRange float64, c routeConstraints) *jumpCache {
+	return &jumpCache{jumpRange: jumpRange, constraints: c, routes: make(map[string]map[string][]string)}
+}
+
+// route returns the stars between two stars and whether the destination is
+// reachable at all.
+func (c *jumpCache) route(from, to string) ([]string, bool) {
+	if c.routes[from] == nil {
+		c.routes[from] = make(map[string][]string)
+	}
+	if jumps, ok := c.routes[from][to]; ok {
+		return jumps, jumps != nil
+	}
+	jumps, err := constrainedRoute(from, to, c.jumpRange, c.constraints)
+	if err != nil {
+		jumps = nil
+	}
+	c.routes[from][to] = jumps
+	return jumps, jumps != nil
+}
+
+// candidateRoutes lists every profitable and reachable route from the query's
+// station: each local item paired with each other station where it's in
+// demand.
+func (s marketStore) candidateRoutes(q routeQuery, jc *jumpCache) (routes []Route) {
+	station := q.Station
+	now := s.marketTime()
+	for _, item := range s.localItems(station, q.CreditLimit) {
+		category := s.itemCategory[item.Item]
+		if !q.allowsCategory(category) {
+			continue
+		}
+		units := loadUnits(q.Cargo, q.CreditLimit, item.BuyPrice, s.stationSupply[station][item.Item].Supply)
+		if units == 0 {
+			continue
+		}
+		for destination, demand := range s.stationDemand {
+			if destination == station || !q.Filter.allows(destination) {
+				continue
+			}
+			t, ok := demand[item.Item]
+			if !ok || t.Demand == 0 || t.SellPrice <= item.BuyPrice {
+				continue
+			}
+			jumps, ok := jc.route(star(station), star(destination))
+			if !ok {
 				// Unreachable.
 				continue
 			}
-			// Optimize for CR/Jump.
-			if crjump = profit / float64(len(jumps)); crjump < bestCRJump {
+			tr := s.newTrade(item.Item, s.stationSupply[station][item.Item], t)
+			n := tr.profitableUnits(units)
+			for n > 0 && tr.cost(0, n) > q.CreditLimit {
+				n--
+			}
+			if n == 0 {
 				continue
 			}
-			d := distance(currentStation, bestPrice.Station)
-			bestRoute = Route{
+			routes = append(routes, Route{
 				Item:               item.Item,
-				SourceStation:      currentStation,
+				Category:           category,
+				SourceStation:      station,
 				BuyPrice:           item.BuyPrice,
-				DestinationStation: bestPrice.Station,
-				SellPrice:          bestPrice.SellPrice,
-				Profit:             profit,
-				Distance:           d,
-				JumpRange:          jumpRange,
+				DestinationStation: destination,
+				SellPrice:          t.SellPrice,
+				Profit:             t.SellPrice - item.BuyPrice,
+				Units:              n,
+				Outlay:             tr.cost(0, n),
+				TotalProfit:        tr.profit(0, n),
+				Runs:               tr.runs(n),
+				Distance:           distance(station, destination),
+				JumpRange:          jc.jumpRange,
 				Jumps:              jumps,
-			}
-			bestProfit = profit
+				Travel:             travel.routeTime(station, destination, len(jumps)-1),
+				Confidence:         s.routeConfidence(item.Item, station, destination, now),
+			})
 		}
-		// TODO: Consider the cargo limit.
 	}
-	// TODO: More routes.
-	routes = []Route{bestRoute}
 	return routes
 }
 
+// bestBuy finds the most profitable routes for a full cargo load from the
+// query's station, ranked by the query's strategy. The same item may appear
+// several times, once for each station where it can be sold.
+func (s marketStore) bestBuy(q routeQuery) ([]Route, error) {
+	routes := s.candidateRoutes(q, newJumpCache(q.JumpRange, q.Constraints))
+	if err := sortRoutes(routes, q.Sort); err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(routes) > q.Limit {
+		routes = routes[:q.Limit]
+	}
+	return routes, nil
+}
+
+// bestSell ranks the reachable stations where qty units of item carried from
+// the query's station can be sold. Routes are ranked by the revenue of the sale, which
+// accounts for both the price and the remaining demand, then by the number of
+// jumps. BuyPrice is zero since the cargo is already in the hold, so the
+// profit is the whole revenue.
+func (s marketStore) bestSell(q routeQuery, item string, qty int) ([]Route, error) {
+	if _, ok := s.itemDemand[item]; !ok {
+		return nil, fmt.Errorf("no demand known for item %q", item)
+	}
+	station, jumpRange := q.Station, q.JumpRange
+	jc := newJumpCache(jumpRange, q.Constraints)
+	now := s.marketTime()
+	var routes []Route
+	for destination, demand := range s.stationDemand {
+		if !q.Filter.allows(destination) {
+			continue
+		}
+		t, ok := demand[item]
+		if !ok || t.Demand == 0 || t.SellPrice == 0 {
+			continue
+		}
+		jumps, ok := jc.route(star(station), star(destination))
+		if !ok {
+			continue
+		}
+		units := qty
+		if t.Demand < units {
+			units = t.Demand
+		}
+		sell, _ := s.elasticities(item)
+		tr := trade{SellPrice: t.SellPrice, Demand: t.Demand, SellElasticity: sell}
+		routes = append(routes, Route{
+			Item:               item,
+			Category:           s.itemCategory[item],
+			SourceStation:      station,
+			DestinationStation: destination,
+			SellPrice:          t.SellPrice,
+			Profit:             t.SellPrice,
+			Units:              units,
+			TotalProfit:        tr.revenue(0, units),
+			Distance:           distance(station, destination),
+			JumpRange:          jumpRange,
+			Jumps:              jumps,
+			Travel:             travel.routeTime(station, destination, len(jumps)-1),
+			Confidence:         s.routeConfidence(item, "", destination, now),
+		})
+	}
+	sort.Sort(routeSorter{routes, func(a, b Route) bool {
+		if a.TotalProfit != b.TotalProfit {
+			return a.TotalProfit > b.TotalProfit
+		}
+		return len(a.Jumps) < len(b.Jumps)
+	}})
+	return routes, nil
+}
+
+// Source is a station selling an item, as seen from the user's location.
+type Source struct {
+	Station  string  `json:"station"`
+	Item     string  `json:"item"`
+	BuyPrice float64 `json:"buyPrice"`
+	Supply   int     `json:"supply"`
+	Distance float64 `json:"distance"`
+	// Jumps are the stars from the user's location to the station.
+	Jumps []string `json:"jumps"`
+}
+
+// JumpsText describes the stars visited on the way to the station, like
+// Route.JumpsText.
+func (s Source) JumpsText() string {
+	return Route{Jumps: s.Jumps}.JumpsText()
+}
+
+// cheapestSources ranks the reachable stations selling item by price, then
+// by stock and then by the jumps needed to get there from the query's
+// station. Stations more than maxJumps away or asking more than maxPrice are
+// left out; zero means no limit.
+func (s marketStore) cheapestSources(q routeQuery, item string, maxJumps int, maxPrice float64) ([]Source, error) {
+	if _, ok := s.itemSupply[item]; !ok {
+		return nil, fmt.Errorf("no supply known for item %q", item)
+	}
+	jc := newJumpCache(q.JumpRange, q.Constraints)
+	var sources []Source
+	for station, supply := range s.stationSupply {
+		t, ok := supply[item]
+		if !ok || t.Supply == 0 || (maxPrice > 0 && t.BuyPrice > maxPrice) || !q.Filter.allows(station) {
+			continue
+		}
+		jumps, ok := jc.route(star(q.Station), star(station))
+		if !ok || (maxJumps > 0 && len(jumps)-1 > maxJumps) {
+			continue
+		}
+		sources = append(sources, Source{
+			Station:  station,
+			Item:     item,
+			BuyPrice: t.BuyPrice,
+			Supply:   t.Supply,
+			Distance: distance(q.Station, station),
+			Jumps:    jumps,
+		})
+	}
+	sort.Sort(sourcesByPrice(sources))
+	return sources, nil
+}
+
+type sourcesByPrice []Source
+
+func (s sourcesByPrice) Len() int      { return len(s) }
+func (s sourcesByPrice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sourcesByPrice) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.BuyPrice != b.BuyPrice {
+		return a.BuyPrice < b.BuyPrice
+	}
+	if a.Supply != b.Supply {
+		return a.Supply > b.Supply
+	}
+	if len(a.Jumps) != len(b.Jumps) {
+		return len(a.Jumps) < len(b.Jumps)
+	}
+	return a.Station < b.Station
+}
+
+// systemStations lists the stations selling goods in a system, whose name is
+// matched ignoring case.
+func (s marketStore) systemStations(system string) (stations []string) {
+	for station := range s.stationSupply {
+		if strings.EqualFold(star(station), system) {
+			stations = append(stations, station)
+		}
+	}
+	sort.Strings(stations)
+	return stations
+}
+
 // Names from 'i Bootis (CHANGO DOCK)' to 'i Bootis'
 func star(station string) string {
 	return strings.Split(station, " (")[0]
@@ -85,6 +382,12 @@ func distance(stationA, stationB string) float64 {
 }
 
 func starRoute(from, to string, jumpRange float64) ([]string, error) {
+	return starRouteAvoiding(from, to, jumpRange, nil)
+}
+
+// starRouteAvoiding is like starRoute but never uses the stars in avoid as
+// waypoints.
+func starRouteAvoiding(from, to string, jumpRange float64, avoid map[string]bool) ([]string, error) {
 	fromLoc, ok := locs[from]
 	if !ok {
 		return nil, fmt.Errorf("starRoute location not found: %v", from)
@@ -93,6 +396,10 @@ func starRoute(from, to string, jumpRange float64) ([]string, error) {
 	if !ok {
 		return nil, fmt.Errorf("starRoute location not found: %v", to)
 	}
+	// Same system, no jump needed.
+	if from == to {
+		return []string{from}, nil
+	}
 	// Are they reachable in one jump?
 	fromDistance := fromLoc.Distance(toLoc)
 	if fromDistance <= jumpRange {
@@ -105,7 +412,7 @@ func starRoute(from, to string, jumpRange float64) ([]string, error) {
 	var distance float64 = 0
 	// TODO: Reduce locs on each run.
 	for star, loc := range locs {
-		if star == to {
+		if star == to || avoid[star] {
 			continue
 		}
 		d := loc.Distance(toLoc)
@@ -118,12 +425,80 @@ func starRoute(from, to string, jumpRange float64) ([]string, error) {
 		}
 	}
 	if next == "" {
+		if len(avoid) > 0 {
+			return nil, fmt.Errorf("No route found between %v and %v avoiding %v", from, to, avoidList(avoid))
+		}
 		return nil, fmt.Errorf("No route found between %v and %v", from, to)
 	}
-	r, err := starRoute(from, next, jumpRange)
+	r, err := starRouteAvoiding(from, next, jumpRange, avoid)
 	return append(r, to), err
 }
 
+// routeConstraints restricts the stars that a route may visit.
+type routeConstraints struct {
+	// Avoid holds stars that can't be visited at all, such as anarchy,
+	// permit-locked or pirate-infested systems.
+	Avoid map[string]bool
+	// Via lists stars that must be visited, in order.
+	Via []string
+}
+
+// validate checks that the constraints only name known stars and don't
+// contradict each other.
+func (c routeConstraints) validate() error {
+	for star := range c.Avoid {
+		if _, ok := locs[star]; !ok {
+			return fmt.Errorf("unknown system to avoid: %v", star)
+		}
+	}
+	for _, star := range c.Via {
+		if _, ok := locs[star]; !ok {
+			return fmt.Errorf("unknown waypoint: %v", star)
+		}
+		if c.Avoid[star] {
+			return fmt.Errorf("waypoint %v is also in the avoid list", star)
+		}
+	}
+	return nil
+}
+
+func (c routeConstraints) empty() bool {
+	return len(c.Avoid) == 0 && len(c.Via) == 0
+}
+
+func avoidList(avoid map[string]bool) string {
+	stars := make([]string, 0, len(avoid))
+	for star := range avoid {
+		stars = append(stars, star)
+	}
+	sort.Strings(stars)
+	return strings.Join(stars, ", ")
+}
+
+// constrainedRoute finds a route between two stars that goes through all the
+// waypoints in c.Via, in order, and never visits the stars in c.Avoid.
+func constrainedRoute(from, to string, jumpRange float64, c routeConstraints) ([]string, error) {
+	if c.empty() {
+		return starRoute(from, to, jumpRange)
+	}
+	if c.Avoid[from] {
+		return nil, fmt.Errorf("route start %v is in the avoid list", from)
+	}
+	if c.Avoid[to] {
+		return nil, fmt.Errorf("route destination %v is in the avoid list", to)
+	}
+	stops := append(append([]string{from}, c.Via...), to)
+	route := []string{from}
+	for i := 1; i < len(stops); i++ {
+		leg, err := starRouteAvoiding(stops[i-1], stops[i], jumpRange, c.Avoid)
+		if err != nil {
+			return nil, err
+		}
+		route = append(route, leg[1:]...)
+	}
+	return route, nil
+}
+
 // Distances from http://forums.frontier.co.uk/showthread.php?t=34824
 // Converted using https://gist.github.com/nictuku/46919118addfa5912f47.
 var locs = map[string]r3.Vector{
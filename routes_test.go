@@ -1,8 +1,10 @@
 package main
 
 import (
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/nictuku/eliteprofit/emdn"
 )
@@ -12,7 +14,8 @@ type routeTest struct {
 	route   Route
 }
 
-func TestBestBuy(t *testing.T) {
+// testStore returns a marketStore filled with the test input.
+func testStore(t *testing.T) *marketStore {
 	count := 0
 	store := newMarketStore()
 	c, err := emdn.TestSubscribe()
@@ -26,20 +29,26 @@ func TestBestBuy(t *testing.T) {
 	if count == 0 {
 		t.Fatalf("Didn't receive any transactions from the test input.")
 	}
+	return store
+}
+
+func TestBestBuy(t *testing.T) {
+	store := testStore(t)
 	tests := []routeTest{
-		{"Eranin (AZEBAN CITY)", Route{Profit: 287, DestinationStation: "Ross 1057 (Wang Estate)"}},
+		{"Eranin (AZEBAN CITY)", Route{Profit: 289, DestinationStation: "h Draconis (Brislington)"}},
 		{"Asellus Primus (BEAGLE 2 LANDING)", Route{Profit: 781, DestinationStation: "Nang Ta-khian (Hay Point)"}},
-		{"LHS 3262 (Louis de Lacaille Prospect)", Route{Profit: 1018, DestinationStation: "Nang Ta-khian (Hay Point)"}},
-		{"Bogus", Route{Profit: 0}},
+		{"LHS 3262 (Louis de Lacaille Prospect)", Route{Profit: 1339, DestinationStation: "i Bootis (CHANGO DOCK)"}},
 	}
 
 	for _, testStation := range tests {
 		// Find the most profitable routes.
-		routes := store.bestBuy(testStation.station, 2000000, 100)
+		routes, err := store.bestBuy(routeQuery{Station: testStation.station, CreditLimit: 2000000, JumpRange: 100, Cargo: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(routes) == 0 {
 			t.Fatalf("nope: got %d wanted > 0 ", len(routes))
 		}
-		// Only the first is filled for now.
 		r := routes[0]
 		if r.DestinationStation != testStation.route.DestinationStation {
 			t.Errorf("testStation %v: destination %v (wanted %v)\n",
@@ -48,6 +57,110 @@ func TestBestBuy(t *testing.T) {
 		if r.Profit != testStation.route.Profit {
 			t.Errorf("testStation %v: price %+v (wanted %v)\n", testStation, r, testStation.route.Profit)
 		}
+		for i := 1; i < len(routes); i++ {
+			if routes[i].TotalProfit > routes[i-1].TotalProfit {
+				t.Errorf("testStation %v: routes not ranked by profit at %d", testStation.station, i)
+			}
+		}
+	}
+	if routes, _ := store.bestBuy(routeQuery{Station: "Bogus", CreditLimit: 2000000, JumpRange: 100, Cargo: 1}); len(routes) != 0 {
+		t.Errorf("got %d routes from an unknown station, wanted none", len(routes))
+	}
+}
+
+func TestBestBuyRanking(t *testing.T) {
+	store := testStore(t)
+	q := routeQuery{Station: "LHS 3262 (Louis de Lacaille Prospect)", CreditLimit: 2000000, JumpRange: 100, Cargo: 1, Limit: 10}
+	routes, err := store.bestBuy(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 10 {
+		t.Fatalf("got %d routes, wanted 10", len(routes))
+	}
+	// The best item can be sold in more than one place.
+	destinations := 0
+	for _, r := range routes {
+		if r.Item == routes[0].Item {
+			destinations++
+		}
+	}
+	if destinations < 2 {
+		t.Errorf("%v: got %d destinations, wanted alternatives", routes[0].Item, destinations)
+	}
+
+	q.Sort = "distance"
+	routes, err = store.bestBuy(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(routes); i++ {
+		if routes[i].Distance < routes[i-1].Distance {
+			t.Errorf("routes not sorted by distance at %d", i)
+		}
+	}
+
+	q.Sort = "crhour"
+	routes, err = store.bestBuy(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(routes); i++ {
+		if routes[i].CRHour() > routes[i-1].CRHour() {
+			t.Errorf("routes not sorted by CR/hour at %d", i)
+		}
+	}
+
+	q.Sort = "bogus"
+	if _, err := store.bestBuy(q); err == nil {
+		t.Errorf("unknown sort order accepted")
+	}
+}
+
+func TestLoadUnits(t *testing.T) {
+	var tests = []struct {
+		cargo       int
+		creditLimit float64
+		price       float64
+		stock       int
+		want        int
+	}{
+		{100, 1000000, 100, 5000, 100},
+		// Not enough stock.
+		{100, 1000000, 100, 8, 8},
+		// Not enough credits.
+		{100, 1050, 100, 5000, 10},
+		{4, 99, 100, 5000, 0},
+		{4, math.MaxFloat64, 100, 5000, 4},
+	}
+	for _, test := range tests {
+		got := loadUnits(test.cargo, test.creditLimit, test.price, test.stock)
+		if got != test.want {
+			t.Errorf("loadUnits(%d, %v, %v, %d) = %d; want %d", test.cargo, test.creditLimit, test.price, test.stock, got, test.want)
+		}
+	}
+}
+
+func TestBestBuyCargo(t *testing.T) {
+	store := testStore(t)
+	routes, err := store.bestBuy(routeQuery{Station: "Asellus Primus (BEAGLE 2 LANDING)", CreditLimit: 100000, JumpRange: 100, Cargo: 20})
+	if err != nil || len(routes) == 0 {
+		t.Fatalf("no routes found: %v", err)
+	}
+	r := routes[0]
+	if r.Units == 0 || r.Units > 20 {
+		t.Fatalf("units %d, wanted between 1 and 20", r.Units)
+	}
+	if r.Outlay > 100000 {
+		t.Errorf("outlay %v exceeds the credit limit", r.Outlay)
+	}
+	// Prices move against the trader with every unit, so the load makes less
+	// than the quoted profit per unit suggests.
+	if r.TotalProfit >= r.Profit*float64(r.Units) || r.TotalProfit <= 0 {
+		t.Errorf("total profit %v, wanted less than %v", r.TotalProfit, r.Profit*float64(r.Units))
+	}
+	if r.Outlay < r.BuyPrice*float64(r.Units) {
+		t.Errorf("outlay %v, wanted at least %v", r.Outlay, r.BuyPrice*float64(r.Units))
 	}
 }
 
@@ -66,6 +179,8 @@ func TestRoute(t *testing.T) {
 		jumpRange float64
 		want      []string
 	}{
+		// Same system.
+		{"Eranin", "Eranin", 6.1, []string{"Eranin"}},
 		// Close neighbors.
 		{"Asellus Primus", "Eranin", 9999, []string{"Asellus Primus", "Eranin"}},
 		// 29LY distance.
@@ -111,3 +226,197 @@ func TestStarName(t *testing.T) {
 		t.Errorf("star name got %q wanted %q", starName, want)
 	}
 }
+
+func TestBestSell(t *testing.T) {
+	store := testStore(t)
+	q := routeQuery{Station: "Eranin (AZEBAN CITY)", JumpRange: 100}
+	routes, err := store.bestSell(q, "tea", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) == 0 {
+		t.Fatalf("no stations buying tea")
+	}
+	for i, r := range routes {
+		demand := store.stationDemand[r.DestinationStation]["tea"].Demand
+		if demand == 0 {
+			t.Errorf("%v has no demand for tea", r.DestinationStation)
+		}
+		if r.Units > 1000 || r.Units > demand {
+			t.Errorf("%v: selling %d units, demand is %d", r.DestinationStation, r.Units, demand)
+		}
+		if i > 0 && r.TotalProfit > routes[i-1].TotalProfit {
+			t.Errorf("routes not ranked by revenue at %d", i)
+		}
+	}
+	// Out of reach with a tiny jump range.
+	if routes, _ := store.bestSell(routeQuery{Station: "Eranin (AZEBAN CITY)", JumpRange: 0.1}, "tea", 1); len(routes) != 0 {
+		t.Errorf("got %d routes with a 0.1 LY jump range, wanted none", len(routes))
+	}
+	if _, err := store.bestSell(q, "bogus", 1); err == nil {
+		t.Errorf("unknown item accepted")
+	}
+}
+
+func TestTripTime(t *testing.T) {
+	m := travelModel{
+		Undock:            30 * time.Second,
+		Jump:              45 * time.Second,
+		Supercruise:       30 * time.Second,
+		SupercruiseSqrtLs: 4 * time.Second,
+		Dock:              60 * time.Second,
+	}
+	// 30 + 2*45 + 30 + 4*sqrt(400) + 60.
+	if got, want := m.tripTime(2, 400), 290*time.Second; got != want {
+		t.Errorf("tripTime(2, 400) = %v; want %v", got, want)
+	}
+	r := Route{TotalProfit: 1000, Jumps: []string{"Eranin", "i Bootis", "Styx"}, Travel: 30 * time.Minute}
+	if r.JumpCount() != 2 {
+		t.Errorf("JumpCount() = %d; want 2", r.JumpCount())
+	}
+	if r.CRJump() != 500 {
+		t.Errorf("CRJump() = %v; want 500", r.CRJump())
+	}
+	if r.CRHour() != 2000 {
+		t.Errorf("CRHour() = %v; want 2000", r.CRHour())
+	}
+}
+
+func TestConstrainedRoute(t *testing.T) {
+	var tests = []struct {
+		from, to    string
+		jumpRange   float64
+		constraints routeConstraints
+		want        []string
+	}{
+		{"Dahan", "Ovid", 6.1, routeConstraints{}, []string{"Dahan", "Asellus Primus", "Eranin", "i Bootis", "Styx", "Opala", "Ovid"}},
+		// Eranin is the only way out of Asellus Primus with this range.
+		{"Dahan", "Ovid", 6.1, routeConstraints{Avoid: map[string]bool{"Eranin": true}}, nil},
+		{"Asellus Primus", "Nang Ta-khian", 13.34, routeConstraints{Avoid: map[string]bool{"Aulin": true}}, []string{"Asellus Primus", "Eranin", "Nang Ta-khian"}},
+		{"Asellus Primus", "Nang Ta-khian", 13.34, routeConstraints{Via: []string{"Eranin"}}, []string{"Asellus Primus", "Eranin", "Nang Ta-khian"}},
+		// The destination itself can't be avoided.
+		{"Asellus Primus", "Eranin", 9999, routeConstraints{Avoid: map[string]bool{"Eranin": true}}, nil},
+	}
+	for _, r := range tests {
+		route, err := constrainedRoute(r.from, r.to, r.jumpRange, r.constraints)
+		if err != nil {
+			route = nil
+		}
+		if !reflect.DeepEqual(route, r.want) {
+			t.Errorf("constrainedRoute(%q, %q, %+v) = %q; want %q", r.from, r.to, r.constraints, route, r.want)
+		}
+		for _, star := range route {
+			if r.constraints.Avoid[star] {
+				t.Errorf("constrainedRoute(%q, %q) visits avoided %v", r.from, r.to, star)
+			}
+		}
+	}
+	if err := (routeConstraints{Via: []string{"Bogus"}}).validate(); err == nil {
+		t.Errorf("unknown waypoint accepted")
+	}
+	if err := (routeConstraints{Avoid: map[string]bool{"Styx": true}, Via: []string{"Styx"}}).validate(); err == nil {
+		t.Errorf("avoided waypoint accepted")
+	}
+}
+
+func TestSameSystemTrade(t *testing.T) {
+	store := newMarketStore()
+	store.record(emdn.Transaction{Item: "gold", Station: "Eranin (AZEBAN CITY)", BuyPrice: 9000, Supply: 100, SellPrice: 8900})
+	store.record(emdn.Transaction{Item: "gold", Station: "Eranin (Other Port)", SellPrice: 9500, Demand: 100})
+	store.record(emdn.Transaction{Item: "gold", Station: "i Bootis (CHANGO DOCK)", SellPrice: 9400, Demand: 100})
+
+	routes, err := store.bestBuy(routeQuery{Station: "Eranin (AZEBAN CITY)", CreditLimit: math.MaxFloat64, JumpRange: 10, Cargo: 1, Sort: "crhour"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, wanted 2", len(routes))
+	}
+	r := routes[0]
+	if r.DestinationStation != "Eranin (Other Port)" {
+		t.Fatalf("best route goes to %v, wanted the station in the same system", r.DestinationStation)
+	}
+	if !r.SameSystem() || r.JumpCount() != 0 || !reflect.DeepEqual(r.Jumps, []string{"Eranin"}) {
+		t.Errorf("same system route has jumps %q", r.Jumps)
+	}
+	if r.Travel >= routes[1].Travel {
+		t.Errorf("same system travel %v, wanted less than the one jump trip %v", r.Travel, routes[1].Travel)
+	}
+	if r.CRJump() != r.TotalProfit {
+		t.Errorf("CRJump() = %v; want %v", r.CRJump(), r.TotalProfit)
+	}
+}
+
+func TestCheapestSources(t *testing.T) {
+	store := testStore(t)
+	q := routeQuery{Station: "Eranin (AZEBAN CITY)", JumpRange: 100}
+	sources, err := store.cheapestSources(q, "consumertechnology", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) < 2 {
+		t.Fatalf("got %d consumertechnology sources, wanted at least 2", len(sources))
+	}
+	for i, src := range sources {
+		if src.Supply == 0 {
+			t.Errorf("%v has no consumertechnology for sale", src.Station)
+		}
+		if i > 0 && src.BuyPrice < sources[i-1].BuyPrice {
+			t.Errorf("sources not ranked by price at %d", i)
+		}
+	}
+
+	maxPrice := sources[0].BuyPrice
+	limited, _ := store.cheapestSources(q, "consumertechnology", 0, maxPrice)
+	for _, src := range limited {
+		if src.BuyPrice > maxPrice {
+			t.Errorf("%v sells for %v, above the %v limit", src.Station, src.BuyPrice, maxPrice)
+		}
+	}
+	if len(limited) == 0 || len(limited) >= len(sources) {
+		t.Errorf("maxprice %v: got %d sources out of %d", maxPrice, len(limited), len(sources))
+	}
+
+	q.JumpRange = 8
+	near, _ := store.cheapestSources(q, "consumertechnology", 1, 0)
+	for _, src := range near {
+		if len(src.Jumps)-1 > 1 {
+			t.Errorf("%v is %d jumps away, wanted at most 1", src.Station, len(src.Jumps)-1)
+		}
+	}
+	if _, err := store.cheapestSources(q, "bogus", 0, 0); err == nil {
+		t.Errorf("unknown item accepted")
+	}
+	if got := (Source{Jumps: []string{"Eranin"}}).JumpsText(); got != "none, same system (Eranin)" {
+		t.Errorf("same system source: got jumps %q", got)
+	}
+}
+
+func TestResolveStation(t *testing.T) {
+	store := testStore(t)
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"Eranin (AZEBAN CITY)", "Eranin (AZEBAN CITY)"},
+		{"eranin (azeban city)", "Eranin (AZEBAN CITY)"},
+		{"azeban", "Eranin (AZEBAN CITY)"},
+		{"hay point", "Nang Ta-khian (Hay Point)"},
+		// Unknown.
+		{"Bogus", ""},
+		// Ambiguous.
+		{"(", ""},
+	}
+	for _, test := range tests {
+		got, err := store.resolveStation(test.name)
+		if (err != nil) != (test.want == "") {
+			t.Errorf("resolveStation(%q) error %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("resolveStation(%q) = %q; want %q", test.name, got, test.want)
+		}
+	}
+	if got := store.systemStations("eranin"); !reflect.DeepEqual(got, []string{"Eranin (AZEBAN CITY)"}) {
+		t.Errorf("systemStations(eranin) = %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	stationsFile = flag.String("stations", "data/stations.json", "station metadata file, updated by the /admin/stations API")
+	adminToken   = flag.String("adminToken", "", "token for the admin APIs, sent in an 'Authorization: Bearer <adminToken>' header; without it, they're read-only")
+)
+
+// padSizes orders the landing pad sizes.
+var padSizes = map[string]int{"S": 1, "M": 2, "L": 3}
+
+// StationInfo describes a station beyond its market.
+type StationInfo struct {
+	Name string `json:"name"`
+	// Pad is the largest landing pad: "S", "M" or "L".
+	Pad string `json:"pad"`
+	// ArrivalLs is the distance from the star in light seconds.
+	ArrivalLs   float64 `json:"arrivalLs"`
+	Refuel      bool    `json:"refuel"`
+	Repair      bool    `json:"repair"`
+	BlackMarket bool    `json:"blackMarket"`
+	Allegiance  string  `json:"allegiance"`
+}
+
+func (info StationInfo) validate() error {
+	if info.Name == "" {
+		return fmt.Errorf("station name missing")
+	}
+	if _, ok := padSizes[info.Pad]; info.Pad != "" && !ok {
+		return fmt.Errorf("station %v: invalid pad size %q, wanted S, M or L", info.Name, info.Pad)
+	}
+	if info.ArrivalLs < 0 {
+		return fmt.Errorf("station %v: negative arrival distance", info.Name)
+	}
+	return nil
+}
+
+// stationRegistry holds the metadata of known stations, keyed by name as
+// reported by EMDN.
+type stationRegistry struct {
+	sync.Mutex
+	path     string
+	stations map[string]StationInfo
+	// changes counts the updates, so that results computed from the
+	// metadata can tell when they're out of date.
+	changes int
+}
+
+// stationInfo is loaded from the -stations file when the program starts.
+var stationInfo = &stationRegistry{stations: make(map[string]StationInfo)}
+
+// load replaces the registry's content with the stations listed in the JSON
+// file at path. A missing file leaves the registry empty.
+func (r *stationRegistry) load(path string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.path = path
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []StationInfo
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	stations := make(map[string]StationInfo)
+	for _, info := range list {
+		info.Pad = strings.ToUpper(info.Pad)
+		if err := info.validate(); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		stations[info.Name] = info
+	}
+	r.stations = stations
+	r.changes++
+	return nil
+}
+
+// save writes the registry to its file. The caller must hold the lock.
+func (r *stationRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// sorted lists the stations by name. The caller must hold the lock.
+func (r *stationRegistry) sorted() []StationInfo {
+	list := make([]StationInfo, 0, len(r.stations))
+	for _, info := range r.stations {
+		list = append(list, info)
+	}
+	sort.Sort(stationsByName(list))
+	return list
+}
+
+func (r *stationRegistry) get(station string) (StationInfo, bool) {
+	r.Lock()
+	defer r.Unlock()
+	info, ok := r.stations[station]
+	return info, ok
+}
+
+// version returns the number of updates made to the registry.
+func (r *stationRegistry) version() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.changes
+}
+
+func (r *stationRegistry) put(info StationInfo) error {
+	if err := info.validate(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	old, ok := r.stations[info.Name]
+	r.stations[info.Name] = info
+	if err := r.save(); err != nil {
+		// Keep serving what's in the file.
+		if ok {
+			r.stations[info.Name] = old
+		} else {
+			delete(r.stations, info.Name)
+		}
+		return err
+	}
+	r.changes++
+	return nil
+}
+
+func (r *stationRegistry) remove(station string) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	old, ok := r.stations[station]
+	if !ok {
+		return false, nil
+	}
+	delete(r.stations, station)
+	if err := r.save(); err != nil {
+		r.stations[station] = old
+		return true, err
+	}
+	r.changes++
+	return true, nil
+}
+
+type stationsByName []StationInfo
+
+func (s stationsByName) Len() int           { return len(s) }
+func (s stationsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s stationsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// stationFilter restricts the stations that routes may visit. Stations without
+// metadata are allowed unless the filter is strict, since most stations
+// haven't been described yet.
+type stationFilter struct {
+	// Pad is the minimum landing pad size: "S", "M" or "L".
+	Pad string
+	// MaxArrivalLs is the maximum distance from the star. Zero means no
+	// limit.
+	MaxArrivalLs float64
+	// Strict leaves out the stations whose metadata can't tell whether they
+	// pass the filter.
+	Strict bool
+}
+
+func (f stationFilter) allows(station string) bool {
+	if f.Pad == "" && f.MaxArrivalLs == 0 {
+		return true
+	}
+	info, ok := stationInfo.get(station)
+	if !ok {
+		return !f.Strict
+	}
+	if f.Pad != "" && info.Pad == "" && f.Strict {
+		return false
+	}
+	if f.Pad != "" && info.Pad != "" && padSizes[info.Pad] < padSizes[f.Pad] {
+		return false
+	}
+	if f.MaxArrivalLs > 0 && info.ArrivalLs > f.MaxArrivalLs {
+		return false
+	}
+	return true
+}
+
+// authorized checks the -adminToken of requests to the admin APIs, and
+// reports the refusal to the client. Without a token, the admin APIs are
+// read-only, so that an exposed server can't be reconfigured by anyone.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if *adminToken == "" {
+		if r.Method == "GET" {
+			return true
+		}
+		http.Error(w, "changes are disabled, start the server with -adminToken to allow them", http.StatusForbidden)
+		return false
+	}
+	want := []byte("Bearer " + *adminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// stationsAdminHandler lists the station metadata on GET, adds or replaces a
+// station from a JSON body on POST or PUT, and removes the station named by
+// the "name" parameter on DELETE.
+func stationsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		stationInfo.Lock()
+		list := stationInfo.sorted()
+		stationInfo.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST", "PUT":
+		var info StationInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info.Pad = strings.ToUpper(info.Pad)
+		if err := info.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := stationInfo.put(info); err != nil {
+			log.Println("stationsAdminHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		found, err := stationInfo.remove(r.FormValue("name"))
+		if err != nil {
+			log.Println("stationsAdminHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "station not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withStations replaces the global station registry for the duration of a
+// test, backed by a file in a temporary directory.
+func withStations(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "eliteprofit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := stationInfo
+	stationInfo = &stationRegistry{stations: make(map[string]StationInfo)}
+	path = filepath.Join(dir, "stations.json")
+	if err := stationInfo.load(path); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() {
+		stationInfo = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStationsAdmin(t *testing.T) {
+	path, cleanup := withStations(t)
+	defer cleanup()
+	defer withAdminToken("secret")()
+
+	req := func(method, url, body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		stationsAdminHandler(w, r)
+		return w
+	}
+	if w := req("POST", "/admin/stations", `{"name": "Eranin (AZEBAN CITY)", "pad": "l", "arrivalLs": 350, "refuel": true}`); w.Code != http.StatusNoContent {
+		t.Fatalf("POST: got %d %q", w.Code, w.Body)
+	}
+	if w := req("POST", "/admin/stations", `{"name": "Ross 1057 (Wang Estate)", "pad": "XL"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with an invalid pad: got %d, wanted %d", w.Code, http.StatusBadRequest)
+	}
+	if w := req("GET", "/admin/stations", ""); !strings.Contains(w.Body.String(), `"pad":"L"`) {
+		t.Errorf("GET: got %q", w.Body)
+	}
+
+	// The file survives a restart.
+	reloaded := &stationRegistry{stations: make(map[string]StationInfo)}
+	if err := reloaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := reloaded.stations["Eranin (AZEBAN CITY)"]; !ok || info.ArrivalLs != 350 || !info.Refuel {
+		t.Errorf("reloaded station: got %+v", info)
+	}
+
+	if w := req("DELETE", "/admin/stations?name=Eranin+(AZEBAN+CITY)", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d %q", w.Code, w.Body)
+	}
+	if w := req("DELETE", "/admin/stations?name=Eranin+(AZEBAN+CITY)", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: got %d, wanted %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestStationsSaveError(t *testing.T) {
+	path, cleanup := withStations(t)
+	defer cleanup()
+	if err := stationInfo.put(StationInfo{Name: "A (A)", Pad: "M"}); err != nil {
+		t.Fatal(err)
+	}
+	// The file can't be written anymore.
+	stationInfo.path = filepath.Join(path, "missing", "stations.json")
+	if err := stationInfo.put(StationInfo{Name: "A (A)", Pad: "L"}); err == nil {
+		t.Error("put succeeded without saving")
+	}
+	if err := stationInfo.put(StationInfo{Name: "B (B)", Pad: "L"}); err == nil {
+		t.Error("put of a new station succeeded without saving")
+	}
+	if _, err := stationInfo.remove("A (A)"); err == nil {
+		t.Error("remove succeeded without saving")
+	}
+	if info, _ := stationInfo.get("A (A)"); info.Pad != "M" {
+		t.Errorf("got %+v after failed changes, want the saved pad M", info)
+	}
+	if _, ok := stationInfo.get("B (B)"); ok {
+		t.Error("unsaved station B is live")
+	}
+}
+
+func TestLoadStationsPadCase(t *testing.T) {
+	path, cleanup := withStations(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(path, []byte(`[{"name": "A (A)", "pad": "l"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := stationInfo.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !(stationFilter{Pad: "L"}).allows("A (A)") || !(stationFilter{Pad: "L", Strict: true}).allows("A (A)") {
+		t.Error("hand-edited pad l doesn't pass an L pad filter")
+	}
+}
+
+// withAdminToken sets the -adminToken flag, until the returned function is
+// called.
+func withAdminToken(token string) func() {
+	old := *adminToken
+	*adminToken = token
+	return func() { *adminToken = old }
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	_, cleanup := withStations(t)
+	defer cleanup()
+	body := `{"name": "Eranin (AZEBAN CITY)", "pad": "L"}`
+	tests := []struct {
+		token, method, auth string
+		want                int
+	}{
+		// Without a token, only reads are allowed.
+		{"", "GET", "", http.StatusOK},
+		{"", "POST", "", http.StatusForbidden},
+		{"", "DELETE", "Bearer ", http.StatusForbidden},
+		{"secret", "GET", "", http.StatusUnauthorized},
+		{"secret", "POST", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "POST", "Bearer secret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		restore := withAdminToken(tt.token)
+		r, _ := http.NewRequest(tt.method, "/admin/stations", strings.NewReader(body))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		stationsAdminHandler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q, %v with %q: got %d, want %d", tt.token, tt.method, tt.auth, w.Code, tt.want)
+		}
+		restore()
+	}
+}
+
+func TestStationFilter(t *testing.T) {
+	_, cleanup := withStations(t)
+	defer cleanup()
+	store := testStore(t)
+
+	q := routeQuery{Station: "Eranin (AZEBAN CITY)", CreditLimit: 2000000, JumpRange: 100, Cargo: 1}
+	routes, _ := store.bestBuy(q)
+	if len(routes) == 0 {
+		t.Fatalf("no routes")
+	}
+	best := routes[0].DestinationStation
+	if err := stationInfo.put(StationInfo{Name: best, Pad: "M", ArrivalLs: 90000}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []stationFilter{{Pad: "L"}, {MaxArrivalLs: 1000}} {
+		q.Filter = f
+		routes, _ = store.bestBuy(q)
+		for _, r := range routes {
+			if r.DestinationStation == best {
+				t.Errorf("filter %+v: route to %v not filtered out", f, best)
+			}
+		}
+	}
+	q.Filter = stationFilter{Pad: "M"}
+	if routes, _ = store.bestBuy(q); len(routes) == 0 || routes[0].DestinationStation != best {
+		t.Errorf("filter %+v: wanted %v to be allowed", q.Filter, best)
+	}
+}
+
+func TestStrictStationFilter(t *testing.T) {
+	_, cleanup := withStations(t)
+	defer cleanup()
+	if err := stationInfo.put(StationInfo{Name: "A (A)", Pad: "L"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stationInfo.put(StationInfo{Name: "B (B)", ArrivalLs: 10}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		f       stationFilter
+		a, b, c bool
+	}{
+		{stationFilter{Pad: "L"}, true, true, true},
+		{stationFilter{Pad: "L", Strict: true}, true, false, false},
+		{stationFilter{MaxArrivalLs: 100, Strict: true}, true, true, false},
+	} {
+		if a, b, c := tt.f.allows("A (A)"), tt.f.allows("B (B)"), tt.f.allows("C (C)"); a != tt.a || b != tt.b || c != tt.c {
+			t.Errorf("%+v: got %v %v %v, want %v %v %v", tt.f, a, b, c, tt.a, tt.b, tt.c)
+		}
+	}
+
+	store := testStore(t)
+	r, _ := http.NewRequest("GET", "/bestbuy?station=azeban&pad=X", nil)
+	if _, err := store.parseRouteQuery(r); err == nil || errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("pad=X: got error %v, want a bad request", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+var dealPercent = flag.Float64("dealPercent", 15, "how far from the galactic average, in percent, a price must be to be flagged as a deal")
+
+// minDealStations is the number of stations quoting an item needed before
+// its prices are compared to the average.
+const minDealStations = 3
+
+// PriceStats summarizes the prices of an item across stations.
+type PriceStats struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	StdDev float64 `json:"stdDev"`
+}
+
+func newPriceStats(prices []float64) (st PriceStats) {
+	st.Count = len(prices)
+	if st.Count == 0 {
+		return st
+	}
+	sorted := append([]float64{}, prices...)
+	sort.Float64s(sorted)
+	st.Min, st.Max = sorted[0], sorted[len(sorted)-1]
+	if n := len(sorted); n%2 == 1 {
+		st.Median = sorted[n/2]
+	} else {
+		st.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	var sum float64
+	for _, p := range sorted {
+		sum += p
+	}
+	st.Mean = sum / float64(st.Count)
+	var squares float64
+	for _, p := range sorted {
+		squares += (p - st.Mean) * (p - st.Mean)
+	}
+	st.StdDev = math.Sqrt(squares / float64(st.Count))
+	return st
+}
+
+// vsAverage is how far price is from the mean, in percent.
+func (st PriceStats) vsAverage(price float64) float64 {
+	if st.Mean == 0 {
+		return 0
+	}
+	return (price - st.Mean) / st.Mean * 100
+}
+
+// ItemStats are the price statistics of an item.
+type ItemStats struct {
+	Item string `json:"item"`
+	// Buy covers the prices stations sell the item at, and Sell the prices
+	// they pay for it.
+	Buy  PriceStats `json:"buy"`
+	Sell PriceStats `json:"sell"`
+}
+
+// buyQuote reports whether a station sells an item, as opposed to only
+// buying it.
+func buyQuote(t emdn.Transaction) bool {
+	return t.Supply > 0 && t.BuyPrice > 0 && t.BuyPrice != math.MaxInt64
+}
+
+func sellQuote(t emdn.Transaction) bool {
+	return t.Demand > 0 && t.SellPrice > 0
+}
+
+// itemStats computes the price statistics of every item over the latest quote
+// of each station.
+func (s marketStore) itemStats() map[string]ItemStats {
+	buy := make(map[string][]float64)
+	sell := make(map[string][]float64)
+	for _, items := range s.stationSupply {
+		for item, t := range items {
+			if buyQuote(t) {
+				buy[item] = append(buy[item], t.BuyPrice)
+			}
+		}
+	}
+	for _, items := range s.stationDemand {
+		for item, t := range items {
+			if sellQuote(t) {
+				sell[item] = append(sell[item], t.SellPrice)
+			}
+		}
+	}
+	stats := make(map[string]ItemStats)
+	for _, item := range s.itemNames() {
+		stats[item] = ItemStats{Item: item, Buy: newPriceStats(buy[item]), Sell: newPriceStats(sell[item])}
+	}
+	return stats
+}
+
+// StationPrice is a station's price for an item compared to the galactic
+// average.
+type StationPrice struct {
+	Station string `json:"station"`
+	Item    string `json:"item"`
+	// Side is "buy" for a price the station sells at and "sell" for a price
+	// it pays.
+	Side      string  `json:"side"`
+	Price     float64 `json:"price"`
+	VsAverage float64 `json:"vsAverage"`
+	// Deal flags prices more than -dealPercent better than the average.
+	Deal bool `json:"deal"`
+}
+
+func newStationPrice(st ItemStats, t emdn.Transaction, side string) StationPrice {
+	p := StationPrice{Station: t.Station, Item: t.Item, Side: side}
+	if side == "buy" {
+		p.Price, p.VsAverage = t.BuyPrice, st.Buy.vsAverage(t.BuyPrice)
+		p.Deal = st.Buy.Count >= minDealStations && p.VsAverage <= -*dealPercent
+	} else {
+		p.Price, p.VsAverage = t.SellPrice, st.Sell.vsAverage(t.SellPrice)
+		p.Deal = st.Sell.Count >= minDealStations && p.VsAverage >= *dealPercent
+	}
+	return p
+}
+
+// stationPrices lists the prices quoted by a station, or for an item, compared
+// to the averages in stats.
+func (s marketStore) stationPrices(stats map[string]ItemStats, station, item string) (prices []StationPrice) {
+	for st, items := range s.stationSupply {
+		for i, t := range items {
+			if (station == "" || st == station) && (item == "" || i == item) && buyQuote(t) {
+				prices = append(prices, newStationPrice(stats[i], t, "buy"))
+			}
+		}
+	}
+	for st, items := range s.stationDemand {
+		for i, t := range items {
+			if (station == "" || st == station) && (item == "" || i == item) && sellQuote(t) {
+				prices = append(prices, newStationPrice(stats[i], t, "sell"))
+			}
+		}
+	}
+	sort.Sort(pricesByItem(prices))
+	return prices
+}
+
+type pricesByItem []StationPrice
+
+func (p pricesByItem) Len() int      { return len(p) }
+func (p pricesByItem) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pricesByItem) Less(i, j int) bool {
+	if p[i].Item != p[j].Item {
+		return p[i].Item < p[j].Item
+	}
+	if p[i].Side != p[j].Side {
+		return p[i].Side < p[j].Side
+	}
+	// Best deals first.
+	if p[i].Price != p[j].Price {
+		return (p[i].Price < p[j].Price) == (p[i].Side == "buy")
+	}
+	return p[i].Station < p[j].Station
+}
+
+// statsResult is the result of a /stats query.
+type statsResult struct {
+	Items []ItemStats `json:"items"`
+	// Prices are the prices of a single station or item.
+	Prices []StationPrice `json:"prices,omitempty"`
+}
+
+func (s marketStore) queryStats(r *http.Request) (res statsResult, err error) {
+	var station, item string
+	if name := r.FormValue("station"); name != "" {
+		if station, err = s.resolveStation(name); err != nil {
+			return res, err
+		}
+	}
+	if name := r.FormValue("item"); name != "" {
+		if item, err = s.resolveItem(name); err != nil {
+			return res, err
+		}
+	}
+	stats := s.itemStats()
+	res.Items = []ItemStats{}
+	for _, st := range stats {
+		if item == "" || st.Item == item {
+			res.Items = append(res.Items, st)
+		}
+	}
+	sort.Sort(statsByItem(res.Items))
+	if station != "" || item != "" {
+		res.Prices = s.stationPrices(stats, station, item)
+	}
+	return res, nil
+}
+
+type statsByItem []ItemStats
+
+func (s statsByItem) Len() int           { return len(s) }
+func (s statsByItem) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s statsByItem) Less(i, j int) bool { return s[i].Item < s[j].Item }
+
+func (st PriceStats) String() string {
+	if st.Count == 0 {
+		return "no quotes"
+	}
+	return fmt.Sprintf("min %v, max %v, mean %.0f, median %v, stddev %.0f (%d stations)", st.Min, st.Max, st.Mean, st.Median, st.StdDev, st.Count)
+}
+
+// vsAverageText describes a price compared to the average.
+func vsAverageText(vs float64, deal bool) string {
+	text := fmt.Sprintf("%.1f%% over the average", vs)
+	if vs < 0 {
+		text = fmt.Sprintf("%.1f%% under the average", -vs)
+	}
+	if deal {
+		text += ", good deal"
+	}
+	return text
+}
+
+// statsHandler shows the price statistics of every item. With the "station"
+// or "item" parameters, it also shows each price of the station or item
+// compared to the average.
+func (s marketStore) statsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	res, err := s.queryStats(r)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	for _, st := range res.Items {
+		fmt.Fprintf(w, "%v:\n  buy: %v\n  sell: %v\n", st.Item, st.Buy, st.Sell)
+	}
+	if len(res.Prices) > 0 {
+		fmt.Fprintf(w, "\n")
+	}
+	for _, p := range res.Prices {
+		fmt.Fprintf(w, "%v %v at %v for %v, %v\n", p.Side, p.Item, p.Station, p.Price, vsAverageText(p.VsAverage, p.Deal))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestPriceStats(t *testing.T) {
+	st := newPriceStats([]float64{4, 1, 3, 2})
+	want := PriceStats{Count: 4, Min: 1, Max: 4, Mean: 2.5, Median: 2.5, StdDev: math.Sqrt(1.25)}
+	if st != want {
+		t.Errorf("got %+v; want %+v", st, want)
+	}
+	if st := newPriceStats([]float64{5, 1, 3}); st.Median != 3 {
+		t.Errorf("odd count: got median %v; want 3", st.Median)
+	}
+	if st := newPriceStats(nil); st != (PriceStats{}) {
+		t.Errorf("no prices: got %+v", st)
+	}
+}
+
+func TestStationPriceDeal(t *testing.T) {
+	st := ItemStats{
+		Buy:  newPriceStats([]float64{80, 100, 120}),
+		Sell: newPriceStats([]float64{100, 100}),
+	}
+	var tests = []struct {
+		t         emdn.Transaction
+		side      string
+		vsAverage float64
+		deal      bool
+	}{
+		{emdn.Transaction{BuyPrice: 80}, "buy", -20, true},
+		{emdn.Transaction{BuyPrice: 90}, "buy", -10, false},
+		{emdn.Transaction{BuyPrice: 120}, "buy", 20, false},
+		// Too few stations to tell.
+		{emdn.Transaction{SellPrice: 150}, "sell", 50, false},
+	}
+	for _, test := range tests {
+		p := newStationPrice(st, test.t, test.side)
+		if math.Abs(p.VsAverage-test.vsAverage) > 1e-9 || p.Deal != test.deal {
+			t.Errorf("%v %+v: got %v%%, deal %v; want %v%%, deal %v", test.side, test.t, p.VsAverage, p.Deal, test.vsAverage, test.deal)
+		}
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	store := testStore(t)
+	r, _ := http.NewRequest("GET", "/stats?item=consumertechnology", nil)
+	res, err := store.queryStats(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Items) != 1 || res.Items[0].Buy.Count == 0 {
+		t.Fatalf("got items %+v", res.Items)
+	}
+	st := res.Items[0].Buy
+	if st.Min > st.Median || st.Median > st.Max || st.Min > st.Mean || st.Mean > st.Max {
+		t.Errorf("inconsistent stats %+v", st)
+	}
+	if len(res.Prices) == 0 {
+		t.Fatalf("no prices")
+	}
+	for _, p := range res.Prices {
+		if p.Item != "consumertechnology" {
+			t.Errorf("got price for %v", p.Item)
+		}
+	}
+}
+
+func TestQuoteVsAverage(t *testing.T) {
+	store := newMarketStore()
+	for i, station := range []string{"A (A)", "B (B)", "C (C)"} {
+		store.record(emdn.Transaction{Station: station, Item: "gold", BuyPrice: float64(100 + 10*i), Supply: 100})
+	}
+	store.record(emdn.Transaction{Station: "A (A)", Item: "silver", BuyPrice: 50, Supply: 100, SellPrice: 60, Demand: 100})
+	r, _ := http.NewRequest("GET", "/buy", nil)
+	quotes, _ := store.queryBuy(r)
+	for _, q := range quotes {
+		switch q.Item {
+		case "gold":
+			// 100 against a mean of 110.
+			if want := -100.0 / 11; q.VsAverage == nil || math.Abs(*q.VsAverage-want) > 1e-9 {
+				t.Errorf("gold: got %v, want %v%%", q.priceText(), want)
+			}
+		case "silver":
+			if q.VsAverage != nil || q.Deal {
+				t.Errorf("silver quoted by one station: got %q, want no comparison", q.priceText())
+			}
+			if text := q.priceText(); text != "50 CR, average n/a" {
+				t.Errorf("silver: got %q", text)
+			}
+		}
+	}
+	quotes, _ = store.querySell(r)
+	for _, q := range quotes {
+		if q.VsAverage != nil {
+			t.Errorf("%v sold by %v stations: got %v%%, want n/a", q.Item, len(quotes), *q.VsAverage)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Strategy is an objective for ranking routes. Routes with a higher score are
+// listed first. New strategies are added with registerStrategy, typically
+// from an init function in their own file.
+type Strategy interface {
+	Score(r Route) float64
+}
+
+// StrategyFunc adapts a scoring function to the Strategy interface.
+type StrategyFunc func(r Route) float64
+
+func (f StrategyFunc) Score(r Route) float64 { return f(r) }
+
+// defaultStrategy is used when a query doesn't name one.
+const defaultStrategy = "profit"
+
+// strategies are the registered ways to rank routes, by name.
+var strategies = map[string]Strategy{
+	// Highest total profit for the load.
+	"profit": StrategyFunc(func(r Route) float64 { return r.TotalProfit }),
+	// Highest profit per unit.
+	"unit": StrategyFunc(func(r Route) float64 { return r.Profit }),
+	// Highest total profit per jump.
+	"crjump": StrategyFunc(Route.CRJump),
+	// Highest total profit per light year.
+	"crly": StrategyFunc(Route.CRLY),
+	// Highest total profit per hour of travel.
+	"crhour": StrategyFunc(Route.CRHour),
+	// Shortest distance.
+	"distance": StrategyFunc(func(r Route) float64 { return -r.Distance }),
+	// Highest total profit, discounted by the chance that the prices are
+	// stale.
+	"risk": StrategyFunc(func(r Route) float64 { return r.TotalProfit * r.Confidence }),
+}
+
+// registerStrategy makes a strategy selectable by name. It panics if the name
+// is already taken, since that's a programming error.
+func registerStrategy(name string, s Strategy) {
+	if _, ok := strategies[name]; ok {
+		panic(fmt.Sprintf("strategy %q registered twice", name))
+	}
+	strategies[name] = s
+}
+
+// strategyNames lists the registered strategies in alphabetical order.
+func strategyNames() []string {
+	var names []string
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupStrategy finds a strategy by name. Empty means defaultStrategy.
+func lookupStrategy(name string) (Strategy, error) {
+	if name == "" {
+		name = defaultStrategy
+	}
+	s, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort order %q, want one of %q", name, strategyNames())
+	}
+	return s, nil
+}
+
+type routeSorter struct {
+	routes []Route
+	less   func(a, b Route) bool
+}
+
+func (r routeSorter) Len() int      { return len(r.routes) }
+func (r routeSorter) Swap(i, j int) { r.routes[i], r.routes[j] = r.routes[j], r.routes[i] }
+func (r routeSorter) Less(i, j int) bool {
+	a, b := r.routes[i], r.routes[j]
+	if r.less(a, b) {
+		return true
+	}
+	if r.less(b, a) {
+		return false
+	}
+	// Break ties consistently so the ranking doesn't depend on map order.
+	if a.TotalProfit != b.TotalProfit {
+		return a.TotalProfit > b.TotalProfit
+	}
+	if a.Item != b.Item {
+		return a.Item < b.Item
+	}
+	return a.DestinationStation < b.DestinationStation
+}
+
+// sortRoutes ranks routes according to the named strategy. It returns an
+// error if the strategy is not known.
+func sortRoutes(routes []Route, name string) error {
+	s, err := lookupStrategy(name)
+	if err != nil {
+		return err
+	}
+	sort.Sort(routeSorter{routes, func(a, b Route) bool { return s.Score(a) > s.Score(b) }})
+	return nil
+}
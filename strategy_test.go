@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStrategies(t *testing.T) {
+	store := testStore(t)
+	q := routeQuery{Station: "LHS 3262 (Louis de Lacaille Prospect)", CreditLimit: math.MaxFloat64, JumpRange: 100, Cargo: 4}
+	for _, name := range strategyNames() {
+		q.Sort = name
+		routes, err := store.bestBuy(q)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(routes) < 2 {
+			t.Fatalf("%v: got %d routes, want several", name, len(routes))
+		}
+		for i := 1; i < len(routes); i++ {
+			if s := strategies[name]; s.Score(routes[i]) > s.Score(routes[i-1]) {
+				t.Errorf("%v: routes not ranked at %d", name, i)
+			}
+		}
+	}
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	registerStrategy("test-cheapest", StrategyFunc(func(r Route) float64 { return -r.BuyPrice }))
+	defer delete(strategies, "test-cheapest")
+	store := testStore(t)
+	routes, err := store.bestBuy(routeQuery{Station: "Eranin (AZEBAN CITY)", CreditLimit: math.MaxFloat64, JumpRange: 100, Cargo: 1, Sort: "test-cheapest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(routes); i++ {
+		if routes[i].BuyPrice < routes[i-1].BuyPrice {
+			t.Errorf("routes not ranked by buy price at %d", i)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic registering a strategy twice")
+		}
+	}()
+	registerStrategy("profit", strategies["crly"])
+}
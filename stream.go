@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+var (
+	streamBuffer        = flag.Int("streamBuffer", 64, "transactions queued for each /stream client; a client that falls further behind misses transactions")
+	streamRouteInterval = flag.Duration("streamRouteInterval", 5*time.Second, "how often /stream recomputes the routes followed by a client, if the market changed")
+)
+
+// streamFilter selects the transactions sent to a /stream client. Empty
+// fields match everything.
+type streamFilter struct {
+	Item    string
+	Station string
+	System  string
+}
+
+func (f streamFilter) matches(t emdn.Transaction) bool {
+	return (f.Item == "" || t.Item == f.Item) &&
+		(f.Station == "" || t.Station == f.Station) &&
+		(f.System == "" || star(t.Station) == f.System)
+}
+
+// streamSub is a /stream client.
+type streamSub struct {
+	filter streamFilter
+	c      chan emdn.Transaction
+	// Guarded by the hub lock.
+	dropped int
+	stale   bool
+}
+
+// streamHub fans out the transactions from the ingestion loop to the /stream
+// clients. Publishing never blocks: a client whose queue is full misses the
+// transaction and is told how many it missed with the next one.
+type streamHub struct {
+	sync.Mutex
+	subs map[*streamSub]bool
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subs: make(map[*streamSub]bool)}
+}
+
+var stream = newStreamHub()
+
+func (h *streamHub) subscribe(filter streamFilter, buffer int) *streamSub {
+	sub := &streamSub{filter: filter, c: make(chan emdn.Transaction, buffer)}
+	h.Lock()
+	defer h.Unlock()
+	h.subs[sub] = true
+	return sub
+}
+
+func (h *streamHub) unsubscribe(sub *streamSub) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subs, sub)
+}
+
+func (h *streamHub) publish(t emdn.Transaction) {
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subs {
+		sub.stale = true
+		if !sub.filter.matches(t) {
+			continue
+		}
+		select {
+		case sub.c <- t:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// takeDropped returns the number of transactions sub missed since the last
+// call.
+func (h *streamHub) takeDropped(sub *streamSub) (n int) {
+	h.Lock()
+	defer h.Unlock()
+	n, sub.dropped = sub.dropped, 0
+	return n
+}
+
+// takeStale reports whether any transaction was published since the last
+// call, which may have changed the routes followed by sub.
+func (h *streamHub) takeStale(sub *streamSub) (stale bool) {
+	h.Lock()
+	defer h.Unlock()
+	stale, sub.stale = sub.stale, false
+	return stale
+}
+
+// streamEvent is a message sent to /stream clients.
+type streamEvent struct {
+	Type        string            `json:"type"` // "transaction" or "routes".
+	Transaction *emdn.Transaction `json:"transaction,omitempty"`
+	// Routes are the best routes from the followed station, sent when they
+	// change.
+	Routes []Route `json:"routes,omitempty"`
+	// Dropped is the number of transactions missed since the previous event
+	// because the client was too slow.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// streamWriter sends events over SSE or WebSocket.
+type streamWriter interface {
+	send(ev streamEvent) error
+	keepalive() error
+	// closed is closed when the client goes away.
+	closed() <-chan struct{}
+}
+
+type sseWriter struct {
+	w    http.ResponseWriter
+	f    http.Flusher
+	done <-chan struct{}
+}
+
+func newSSEWriter(w http.ResponseWriter, r *http.Request) (*sseWriter, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, &statusError{http.StatusInternalServerError, "streaming not supported by the server"}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	return &sseWriter{w, f, r.Context().Done()}, nil
+}
+
+func (s *sseWriter) send(ev streamEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %v\ndata: %s\n\n", ev.Type, data); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+func (s *sseWriter) keepalive() error {
+	if _, err := fmt.Fprint(s.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+func (s *sseWriter) closed() <-chan struct{} { return s.done }
+
+func (c *wsConn) send(ev streamEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+func (c *wsConn) keepalive() error        { return c.writeFrame(wsPing, nil) }
+func (c *wsConn) closed() <-chan struct{} { return c.done }
+
+// streamHandler pushes the transactions matching the "item", "station" and
+// "system" parameters as they arrive, over WebSocket if the client asks for
+// an upgrade and as Server-Sent Events otherwise. With the "routes"
+// parameter, it also sends the best routes from the station whenever they
+// change.
+func (s marketStore) streamHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	filter, q, follow, err := s.parseStreamQuery(r)
+	mu.Unlock()
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	var out streamWriter
+	if isWebSocket(r) {
+		c, err := acceptWebSocket(w, r)
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		defer c.Close()
+		out = c
+	} else {
+		if out, err = newSSEWriter(w, r); err != nil {
+			queryError(w, err)
+			return
+		}
+	}
+	sub := stream.subscribe(filter, *streamBuffer)
+	defer stream.unsubscribe(sub)
+
+	var routes []Route
+	sendRoutes := func() error {
+		mu.Lock()
+		latest, _ := s.bestBuy(q)
+		mu.Unlock()
+		if routes != nil && reflect.DeepEqual(latest, routes) {
+			return nil
+		}
+		routes = append([]Route{}, latest...)
+		return out.send(streamEvent{Type: "routes", Routes: routes})
+	}
+	if follow {
+		stream.takeStale(sub)
+		if err := sendRoutes(); err != nil {
+			return
+		}
+	}
+	tick := time.NewTicker(*streamRouteInterval)
+	defer tick.Stop()
+	for {
+		var err error
+		select {
+		case t := <-sub.c:
+			err = out.send(streamEvent{Type: "transaction", Transaction: &t, Dropped: stream.takeDropped(sub)})
+		case <-tick.C:
+			if follow && stream.takeStale(sub) {
+				err = sendRoutes()
+			} else {
+				err = out.keepalive()
+			}
+		case <-out.closed():
+			return
+		}
+		if err != nil {
+			log.Println("streamHandler:", err)
+			return
+		}
+	}
+}
+
+// parseStreamQuery reads the /stream parameters. The caller must hold the
+// lock.
+func (s marketStore) parseStreamQuery(r *http.Request) (f streamFilter, q routeQuery, follow bool, err error) {
+	if item := r.FormValue("item"); item != "" {
+		if f.Item, err = s.resolveItem(item); err != nil {
+			return
+		}
+	}
+	if system := r.FormValue("system"); system != "" {
+		if f.System, err = resolveSystem(system); err != nil {
+			return
+		}
+	}
+	if q, err = s.parseRouteQuery(r); err != nil {
+		return
+	}
+	f.Station = q.Station
+	if follow = r.FormValue("routes") != ""; follow {
+		if q.Station == "" {
+			err = fmt.Errorf("following routes needs the station parameter")
+			return
+		}
+		if q.Limit <= 0 {
+			q.Limit = 5
+		}
+	}
+	return
+}
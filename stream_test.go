@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nictuku/eliteprofit/emdn"
+)
+
+func TestStreamHub(t *testing.T) {
+	h := newStreamHub()
+	sub := h.subscribe(streamFilter{Item: "gold"}, 1)
+	h.publish(emdn.Transaction{Item: "gold", SellPrice: 1})
+	// The queue is full, this one is dropped without blocking.
+	h.publish(emdn.Transaction{Item: "gold", SellPrice: 2})
+	h.publish(emdn.Transaction{Item: "silver"})
+	if got := <-sub.c; got.SellPrice != 1 {
+		t.Errorf("got %+v, wanted the first transaction", got)
+	}
+	select {
+	case got := <-sub.c:
+		t.Errorf("got unexpected %+v", got)
+	default:
+	}
+	if n := h.takeDropped(sub); n != 1 {
+		t.Errorf("dropped %d, wanted 1", n)
+	}
+	if !h.takeStale(sub) || h.takeStale(sub) {
+		t.Errorf("takeStale should report the market change once")
+	}
+	h.unsubscribe(sub)
+	h.publish(emdn.Transaction{Item: "gold"})
+	if len(sub.c) != 0 {
+		t.Errorf("unsubscribed client still receives transactions")
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	tr := emdn.Transaction{Item: "gold", Station: "Eranin (AZEBAN CITY)"}
+	var tests = []struct {
+		f    streamFilter
+		want bool
+	}{
+		{streamFilter{}, true},
+		{streamFilter{Item: "gold", System: "Eranin"}, true},
+		{streamFilter{Station: "Eranin (AZEBAN CITY)"}, true},
+		{streamFilter{Item: "silver"}, false},
+		{streamFilter{System: "Asellus Primus"}, false},
+	}
+	for _, test := range tests {
+		if got := test.f.matches(tr); got != test.want {
+			t.Errorf("%+v.matches = %v; want %v", test.f, got, test.want)
+		}
+	}
+}
+
+// publishUntilSubscribed publishes t once a client is subscribed.
+func publishUntilSubscribed(t *testing.T, tr emdn.Transaction) {
+	for i := 0; ; i++ {
+		stream.Lock()
+		n := len(stream.subs)
+		stream.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("client never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream.publish(tr)
+}
+
+func TestStreamSSE(t *testing.T) {
+	store := testStore(t)
+	ts := httptest.NewServer(http.HandlerFunc(store.streamHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/stream?item=consumertechnology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	publishUntilSubscribed(t, emdn.Transaction{Item: "consumertechnology", Station: "Eranin (AZEBAN CITY)", SellPrice: 123})
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "event: transaction\n" {
+			break
+		}
+	}
+	data, _ := r.ReadString('\n')
+	var ev streamEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &ev); err != nil {
+		t.Fatalf("%v in %q", err, data)
+	}
+	if ev.Transaction == nil || ev.Transaction.SellPrice != 123 {
+		t.Errorf("got event %+v", ev)
+	}
+
+	if resp, err := http.Get(ts.URL + "/stream?routes=1"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("following routes without a station: got %v %v", resp.Status, err)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	store := testStore(t)
+	ts := httptest.NewServer(http.HandlerFunc(store.streamHandler))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /stream?system=eranin HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example from RFC 6455.
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: got %v %v", resp.Status, resp.Header)
+	}
+
+	publishUntilSubscribed(t, emdn.Transaction{Item: "gold", Station: "Eranin (AZEBAN CITY)", SellPrice: 456})
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x80|wsText || h[1]&0x80 != 0 {
+		t.Fatalf("frame header %x", h)
+	}
+	n := int(h[1])
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	var ev streamEvent
+	if err := json.Unmarshal(payload, &ev); err != nil || ev.Type != "transaction" || ev.Transaction.SellPrice != 456 {
+		t.Errorf("got %q, %v", payload, err)
+	}
+
+	// A masked close frame is answered with a close frame.
+	conn.Write([]byte{0x80 | wsClose, 0x80, 1, 2, 3, 4})
+	if _, err := io.ReadFull(r, h[:]); err != nil || h[0] != 0x80|wsClose {
+		t.Errorf("close: got %x, %v", h, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"time"
+)
+
+// travelModel estimates how long a trip between two stations takes. Docking
+// and supercruise often take longer than the hyperspace jumps themselves, so
+// they are accounted for separately.
+type travelModel struct {
+	// Undock covers leaving the station and its mass lock.
+	Undock time.Duration
+	// Jump covers charging the frame shift drive and the hyperspace tunnel.
+	Jump time.Duration
+	// Supercruise is the fixed part of the trip from the arrival star to
+	// the station. Ships accelerate in supercruise, so the rest grows with
+	// the square root of the station's distance from the star, at
+	// SupercruiseSqrtLs per sqrt(ls).
+	Supercruise       time.Duration
+	SupercruiseSqrtLs time.Duration
+	// Dock covers the approach and landing.
+	Dock time.Duration
+	// ArrivalLs is the distance from the star assumed for stations whose
+	// distance isn't known.
+	ArrivalLs float64
+}
+
+var travel = travelModel{
+	Undock:            30 * time.Second,
+	Jump:              45 * time.Second,
+	Supercruise:       30 * time.Second,
+	SupercruiseSqrtLs: 4 * time.Second,
+	Dock:              60 * time.Second,
+	ArrivalLs:         500,
+}
+
+func init() {
+	flag.DurationVar(&travel.Undock, "undockTime", travel.Undock, "time to undock and leave the station's mass lock, used for CR/hour")
+	flag.DurationVar(&travel.Jump, "jumpTime", travel.Jump, "time per hyperspace jump, used for CR/hour")
+	flag.DurationVar(&travel.Supercruise, "supercruiseTime", travel.Supercruise, "fixed supercruise time from the arrival star to a station, used for CR/hour")
+	flag.DurationVar(&travel.SupercruiseSqrtLs, "supercruiseSqrtLs", travel.SupercruiseSqrtLs, "supercruise time per square root of the station's distance from the star in ls, used for CR/hour")
+	flag.DurationVar(&travel.Dock, "dockTime", travel.Dock, "time to approach and dock at a station, used for CR/hour")
+	flag.Float64Var(&travel.ArrivalLs, "arrivalLs", travel.ArrivalLs, "distance of stations from their star in ls when not known, used for CR/hour")
+}
+
+// tripTime estimates the time from undocking at a station to docking at
+// another one, arrivalLs away from its star, after the given number of jumps.
+func (m travelModel) tripTime(jumps int, arrivalLs float64) time.Duration {
+	supercruise := m.Supercruise + time.Duration(math.Sqrt(arrivalLs)*float64(m.SupercruiseSqrtLs))
+	return m.Undock + time.Duration(jumps)*m.Jump + supercruise + m.Dock
+}
+
+// routeTime estimates the travel time between two stations, given the number
+// of hyperspace jumps between their stars. Stations in the same system are
+// only a supercruise apart.
+func (m travelModel) routeTime(from, to string, jumps int) time.Duration {
+	ls := m.arrivalLs(to)
+	if jumps == 0 {
+		ls = math.Abs(ls - m.arrivalLs(from))
+	}
+	return m.tripTime(jumps, ls)
+}
+
+// arrivalLs returns the distance of a station from its star, falling back to
+// the model's default when the station's metadata doesn't have it.
+func (m travelModel) arrivalLs(station string) float64 {
+	if info, ok := stationInfo.get(station); ok && info.ArrivalLs > 0 {
+		return info.ArrivalLs
+	}
+	return m.ArrivalLs
+}
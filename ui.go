@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The browser UI. It's rendered from the same queries as the text views and
+// the JSON API, and needs nothing but this binary: the templates, stylesheet
+// and script are all in this package.
+
+// uiPage is the data of every UI page.
+type uiPage struct {
+	Title string
+	Error string
+	// Form holds the query parameters, to fill in the forms and build links.
+	Form url.Values
+	Data interface{}
+}
+
+// uiLeg is a jump of a route detail page.
+type uiLeg struct {
+	From, To string
+	Distance float64
+}
+
+// uiRouteDetail is the data of a route detail page.
+type uiRouteDetail struct {
+	Route Route
+	Legs  []uiLeg
+}
+
+// uiPrices is the data of the prices page.
+type uiPrices struct {
+	Buy, Sell []Quote
+}
+
+var uiFuncs = template.FuncMap{
+	"cr": func(v float64) string {
+		if v == math.MaxFloat64 || v == math.MaxInt64 {
+			return "N/A"
+		}
+		return fmt.Sprintf("%.0f", v)
+	},
+	"ly":            func(v float64) string { return fmt.Sprintf("%.1f", v) },
+	"signedPercent": func(v float64) string { return fmt.Sprintf("%+.1f%%", v) },
+	"duration":      func(d time.Duration) string { return d.Round(time.Second).String() },
+	"age": func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return time.Since(t).Truncate(time.Minute).String()
+	},
+	"unix": func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	},
+	// routeURL links to the detail page of a route found with the
+	// parameters in form.
+	"routeURL": func(form url.Values, r Route) string {
+		params := url.Values{}
+		for k, v := range form {
+			params[k] = v
+		}
+		params.Del("system")
+		params.Set("station", r.SourceStation)
+		params.Set("item", r.Item)
+		params.Set("to", r.DestinationStation)
+		return "/ui/route?" + params.Encode()
+	},
+	// quotesTable passes a table of quotes and its quantity header to the
+	// "quotes" template.
+	"quotesTable": func(quotes []Quote, quantity string) interface{} {
+		return struct {
+			Quotes   []Quote
+			Quantity string
+		}{quotes, quantity}
+	},
+}
+
+var uiTemplates = template.Must(template.New("ui").Funcs(uiFuncs).Parse(uiTemplateText))
+
+const uiTemplateText = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - eliteprofit</title>
+<link rel="stylesheet" href="/static/ui.css">
+<script src="/static/ui.js" defer></script>
+</head>
+<body>
+<nav><a href="/">Routes</a> <a href="/ui/prices">Prices</a></nav>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<form method="get" action="/">
+<label>Station <input name="station" value="{{.Form.Get "station"}}" list="names" data-search autofocus></label>
+<label>Credits <input name="cr" type="number" min="0" value="{{.Form.Get "cr"}}"></label>
+<label>Ship cargo (t) <input name="cargo" type="number" min="1" value="{{.Form.Get "cargo"}}"></label>
+<label>Jump range (LY) <input name="jr" type="number" min="0" step="0.1" value="{{.Form.Get "jr"}}"></label>
+<label>Exclude categories <input name="exclude" value="{{.Form.Get "exclude"}}" placeholder="e.g. drugs,weapons"></label>
+<label>Rank by <select name="sort">
+{{$sort := .Form.Get "sort"}}
+<option value="profit"{{if eq $sort "profit"}} selected{{end}}>total profit</option>
+<option value="unit"{{if eq $sort "unit"}} selected{{end}}>profit per unit</option>
+<option value="crjump"{{if eq $sort "crjump"}} selected{{end}}>profit per jump</option>
+<option value="crly"{{if eq $sort "crly"}} selected{{end}}>profit per light year</option>
+<option value="crhour"{{if eq $sort "crhour"}} selected{{end}}>profit per hour</option>
+<option value="risk"{{if eq $sort "risk"}} selected{{end}}>profit weighted by confidence</option>
+<option value="distance"{{if eq $sort "distance"}} selected{{end}}>distance</option>
+</select></label>
+<input name="n" type="hidden" value="{{or (.Form.Get "n") "20"}}">
+<button type="submit">Find routes</button>
+<datalist id="names"></datalist>
+</form>
+{{$form := .Form}}
+{{with .Data}}{{range .Stations}}
+<h2>Buying from {{.Station}}</h2>
+{{if .Routes}}
+<table class="sortable">
+<thead><tr>
+<th>Item</th><th>Buy</th><th>Sell to</th><th>Sell</th><th>Profit/unit</th><th>Units</th>
+<th>Total profit</th><th>Runs</th><th>Jumps</th><th>Distance (LY)</th><th>CR/jump</th><th>CR/hour</th><th>Travel</th><th>Confidence</th><th></th>
+</tr></thead>
+<tbody>
+{{range .Routes}}<tr>
+<td>{{.Item}}</td>
+<td data-value="{{.BuyPrice}}">{{cr .BuyPrice}}</td>
+<td>{{.DestinationStation}}</td>
+<td data-value="{{.SellPrice}}">{{cr .SellPrice}}</td>
+<td data-value="{{.Profit}}">{{cr .Profit}}</td>
+<td data-value="{{.Units}}">{{.Units}}</td>
+<td data-value="{{.TotalProfit}}">{{cr .TotalProfit}}</td>
+<td data-value="{{.Runs}}">{{.Runs}}</td>
+<td data-value="{{.JumpCount}}">{{.JumpCount}}</td>
+<td data-value="{{.Distance}}">{{ly .Distance}}</td>
+<td data-value="{{.CRJump}}">{{cr .CRJump}}</td>
+<td data-value="{{.CRHour}}">{{cr .CRHour}}</td>
+<td data-value="{{.Travel.Seconds}}">{{duration .Travel}}</td>
+<td data-value="{{.Confidence}}">{{printf "%.2f" .Confidence}}</td>
+<td><a href="{{routeURL $form .}}">details</a></td>
+</tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>No routes found.</p>{{end}}
+{{end}}{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "route"}}{{template "header" .}}
+{{with .Data}}{{with .Route}}
+<p>Buy {{.Units}} {{.Item}} at {{.SourceStation}} for {{cr .BuyPrice}} CR each
+and sell them to {{.DestinationStation}} for {{cr .SellPrice}} CR each.</p>
+<dl>
+<dt>Outlay</dt><dd>{{cr .Outlay}} CR</dd>
+<dt>Total profit</dt><dd>{{cr .TotalProfit}} CR ({{cr .Profit}} CR per unit at the quoted prices)</dd>
+<dt>Repeat runs</dt><dd>{{.Runs}} before the prices stop paying</dd>
+<dt>Jumps</dt><dd>{{.JumpCount}}, {{ly .Distance}} LY</dd>
+<dt>Travel time</dt><dd>{{duration .Travel}}, {{cr .CRHour}} CR/hour</dd>
+<dt>Confidence</dt><dd>{{printf "%.2f" .Confidence}}</dd>
+</dl>
+{{end}}
+{{if .Legs}}
+<table class="sortable">
+<thead><tr><th>#</th><th>From</th><th>To</th><th>Distance (LY)</th></tr></thead>
+<tbody>
+{{range $i, $leg := .Legs}}<tr>
+<td data-value="{{$i}}">{{$i}}</td><td>{{$leg.From}}</td><td>{{$leg.To}}</td>
+<td data-value="{{$leg.Distance}}">{{ly $leg.Distance}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>Same system, no jump needed.</p>{{end}}
+{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "quotes"}}
+<table class="sortable">
+<thead><tr><th>Item</th><th>Station</th><th>Price</th><th>Vs average</th><th>{{.Quantity}}</th><th>Updated</th></tr></thead>
+<tbody>
+{{range .Quotes}}<tr>
+<td>{{.Item}}</td><td>{{.Station}}</td>
+{{if .Price}}<td data-value="{{.Price}}">{{cr .Price}}</td>
+{{if .VsAverage}}<td data-value="{{.VsAverage}}"{{if .Deal}} class="deal"{{end}}>{{signedPercent .VsAverage}}{{if .Deal}} deal{{end}}</td>
+{{else}}<td data-value="">n/a</td>{{end}}
+{{else}}<td data-value="">N/A</td><td data-value=""></td>{{end}}
+<td data-value="{{.Quantity}}">{{.Quantity}}</td>
+<td data-value="{{unix .Updated}}">{{age .Updated}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+
+{{define "prices"}}{{template "header" .}}
+{{with .Data}}
+<h2>Where to buy</h2>
+{{template "quotes" quotesTable .Buy "Supply"}}
+<h2>Where to sell</h2>
+{{template "quotes" quotesTable .Sell "Demand"}}
+{{end}}
+{{template "footer" .}}{{end}}
+`
+
+// renderUI executes a UI template. The page is buffered so that template
+// errors can still be reported with a proper status.
+func renderUI(w http.ResponseWriter, status int, name string, page uiPage) {
+	var buf bytes.Buffer
+	if err := uiTemplates.ExecuteTemplate(&buf, name, page); err != nil {
+		log.Println("renderUI:", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// uiIndexHandler shows the route search form, and the routes found if a
+// station or system was given.
+func (s marketStore) uiIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	page := uiPage{Title: "Best routes", Form: r.URL.Query()}
+	status := http.StatusOK
+	if r.FormValue("station") != "" || r.FormValue("system") != "" {
+		mu.Lock()
+		res, err := s.queryBestBuy(r)
+		mu.Unlock()
+		if err != nil {
+			page.Error, status = err.Error(), errorStatus(err)
+		} else {
+			page.Data = res
+		}
+	}
+	renderUI(w, status, "index", page)
+}
+
+// findRoute finds the route carrying item from the query's station to
+// destination.
+func (s marketStore) findRoute(q routeQuery, item, destination string) (Route, bool) {
+	for _, route := range s.candidateRoutes(q, newJumpCache(q.JumpRange, q.Constraints)) {
+		if route.Item == item && route.DestinationStation == destination {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+func (s marketStore) queryRouteDetail(r *http.Request) (res uiRouteDetail, err error) {
+	q, err := s.parseRouteQuery(r)
+	if err != nil {
+		return res, err
+	}
+	if q.Station == "" {
+		return res, fmt.Errorf("missing station parameter")
+	}
+	item, err := s.resolveItem(r.FormValue("item"))
+	if err != nil {
+		return res, err
+	}
+	to, err := s.resolveStation(r.FormValue("to"))
+	if err != nil {
+		return res, err
+	}
+	route, ok := s.findRoute(q, item, to)
+	if !ok {
+		return res, &statusError{http.StatusNotFound, fmt.Sprintf("no profitable route for %v from %v to %v", item, q.Station, to)}
+	}
+	res.Route = route
+	for i := 1; i < len(route.Jumps); i++ {
+		res.Legs = append(res.Legs, uiLeg{route.Jumps[i-1], route.Jumps[i], distance(route.Jumps[i-1], route.Jumps[i])})
+	}
+	return res, nil
+}
+
+// uiRouteHandler shows the details of one route, with the distance of each
+// jump.
+func (s marketStore) uiRouteHandler(w http.ResponseWriter, r *http.Request) {
+	page := uiPage{Title: "Route", Form: r.URL.Query()}
+	status := http.StatusOK
+	mu.Lock()
+	res, err := s.queryRouteDetail(r)
+	mu.Unlock()
+	if err != nil {
+		page.Error, status = err.Error(), errorStatus(err)
+	} else {
+		page.Data = res
+	}
+	renderUI(w, status, "route", page)
+}
+
+// uiPricesHandler shows the best buying and selling prices of every item.
+func (s marketStore) uiPricesHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	buy, _ := s.queryBuy(r)
+	sell, _ := s.querySell(r)
+	mu.Unlock()
+	renderUI(w, http.StatusOK, "prices", uiPage{Title: "Prices", Form: r.URL.Query(), Data: uiPrices{buy, sell}})
+}
+
+// staticAssets are served under /static/.
+var staticAssets = map[string]struct {
+	contentType string
+	body        string
+}{
+	"ui.css": {"text/css; charset=utf-8", uiCSS},
+	"ui.js":  {"application/javascript; charset=utf-8", uiJS},
+}
+
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	asset, ok := staticAssets[r.URL.Path[len("/static/"):]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Cache-Control", "max-age=3600")
+	fmt.Fprint(w, asset.body)
+}
+
+const uiCSS = `body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+nav a { margin-right: 1em; }
+form label { display: inline-block; margin: 0 1em 0.5em 0; }
+input[type=number] { width: 7em; }
+.error { color: #b00; font-weight: bold; }
+.deal { color: #080; font-weight: bold; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { padding: 0.2em 0.6em; border-bottom: 1px solid #ddd; text-align: left; }
+td[data-value] { text-align: right; }
+table.sortable th { cursor: pointer; user-select: none; background: #f4f4f4; }
+th.asc::after { content: " \25b2"; }
+th.desc::after { content: " \25bc"; }
+dt { font-weight: bold; }
+`
+
+const uiJS = `// Sortable tables: click a header to sort by that column, again to reverse.
+// Cells with a data-value attribute sort numerically by it.
+document.querySelectorAll("table.sortable").forEach(function(table) {
+  table.querySelectorAll("thead th").forEach(function(th, col) {
+    th.addEventListener("click", function() {
+      var desc = !th.classList.contains("desc");
+      table.querySelectorAll("thead th").forEach(function(h) { h.classList.remove("asc", "desc"); });
+      th.classList.add(desc ? "desc" : "asc");
+      var tbody = table.tBodies[0];
+      var rows = Array.prototype.slice.call(tbody.rows);
+      var key = function(row) {
+        var cell = row.cells[col];
+        if (cell.hasAttribute("data-value")) {
+          var v = parseFloat(cell.getAttribute("data-value"));
+          return isNaN(v) ? -Infinity : v;
+        }
+        return cell.textContent.toLowerCase();
+      };
+      rows.sort(function(a, b) {
+        var ka = key(a), kb = key(b);
+        var c = ka < kb ? -1 : ka > kb ? 1 : 0;
+        return desc ? -c : c;
+      });
+      rows.forEach(function(row) { tbody.appendChild(row); });
+    });
+  });
+});
+
+// Station name completion from /search.
+document.querySelectorAll("input[data-search]").forEach(function(input) {
+  var list = document.getElementById(input.getAttribute("list"));
+  input.addEventListener("input", function() {
+    if (input.value.length < 2) {
+      return;
+    }
+    fetch("/search?n=10&q=" + encodeURIComponent(input.value))
+      .then(function(r) { return r.json(); })
+      .then(function(matches) {
+        list.innerHTML = "";
+        matches.forEach(function(m) {
+          if (m.kind !== "station") {
+            return;
+          }
+          var option = document.createElement("option");
+          option.value = m.name;
+          list.appendChild(option);
+        });
+      });
+  });
+});
+`
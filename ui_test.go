@@ -0,0 +1,58 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func uiGet(t *testing.T, handler http.HandlerFunc, url string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestUI(t *testing.T) {
+	store := testStore(t)
+
+	w := uiGet(t, store.uiIndexHandler, "/?station=azeban&jr=100&cargo=10")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Buying from Eranin (AZEBAN CITY)") {
+		t.Fatalf("index: got %d %q", w.Code, w.Body)
+	}
+	link := regexp.MustCompile(`href="(/ui/route\?[^"]+)"`).FindStringSubmatch(w.Body.String())
+	if link == nil {
+		t.Fatalf("index: no route detail link in %q", w.Body)
+	}
+	detail := html.UnescapeString(link[1])
+	if w := uiGet(t, store.uiRouteHandler, detail); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Distance (LY)") {
+		t.Errorf("%v: got %d %q", detail, w.Code, w.Body)
+	}
+
+	if w := uiGet(t, store.uiIndexHandler, "/?station=Bogus"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `class="error"`) {
+		t.Errorf("unknown station: got %d %q", w.Code, w.Body)
+	}
+	if w := uiGet(t, store.uiPricesHandler, "/ui/prices"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Where to sell") {
+		t.Errorf("prices: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestUIOffline(t *testing.T) {
+	for name, text := range map[string]string{"templates": uiTemplateText, "ui.css": uiCSS, "ui.js": uiJS} {
+		if strings.Contains(text, "//cdn") || strings.Contains(text, "http://") || strings.Contains(text, "https://") {
+			t.Errorf("%v refers to an external resource", name)
+		}
+	}
+	if w := uiGet(t, staticHandler, "/static/ui.js"); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/javascript") {
+		t.Errorf("ui.js: got %d %v", w.Code, w.Header())
+	}
+	if w := uiGet(t, staticHandler, "/static/bogus.js"); w.Code != http.StatusNotFound {
+		t.Errorf("bogus.js: got %d", w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side of the WebSocket protocol (RFC 6455), enough to push
+// text messages to browsers and bots. Messages from the client are read only
+// to answer pings and close requests.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsMaxPayload limits the size of the frames accepted from clients.
+const wsMaxPayload = 1 << 16
+
+// wsWriteTimeout bounds how long a write to a stuck client may block.
+const wsWriteTimeout = 10 * time.Second
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	// mu serializes the writes of the sender and of the read loop.
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptWebSocket completes the opening handshake and takes over the
+// connection.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("bad websocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, &statusError{http.StatusInternalServerError, "websocket not supported by the server"}
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, &statusError{http.StatusInternalServerError, err.Error()}
+	}
+	c := &wsConn{conn: conn, rw: rw, done: make(chan struct{})}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// writeFrame sends an unfragmented, unmasked frame, as servers do.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// readFrame reads a frame from the client, which must be masked.
+func (c *wsConn) readFrame() (opcode byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.rw, h[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = h[0] & 0x0F
+	if h[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("unmasked websocket frame")
+	}
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxPayload {
+		return 0, nil, fmt.Errorf("websocket frame too large: %d bytes", n)
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers the client's control frames until the connection ends.
+func (c *wsConn) readLoop() {
+	defer c.Close()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return
+		}
+	}
+}
+
+// Close ends the connection. It's safe to call more than once.
+func (c *wsConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}